@@ -3,12 +3,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -61,6 +64,80 @@ type order struct {
 	Attribute6            string `json:"attribute6"`
 	InvalidTrx            string `json:"invalidTrx"`
 	Count                 int    `json:"count"`
+	//COO compliance verdict (Yes/No) and the time of verification, used by rich queries
+	COOCompliant     string    `json:"cooCompliant"`
+	VerificationDate time.Time `json:"verificationDate"`
+	//Preferential trade agreement eligibility of the shipment
+	Preference *preferenceDetermination `json:"preference"`
+}
+
+//Preferential trade agreement with member countries and qualifying rules
+type tradeAgreement struct {
+	ObjectType      string    `json:"objectType"`
+	AgreementID     string    `json:"agreementID"`
+	Name            string    `json:"name"`
+	MemberCountries []string  `json:"memberCountries"`
+	ItemPrefixes    []string  `json:"itemPrefixes"`
+	ExcludedItems   []string  `json:"excludedItems"`
+	MinOrderValue   float64   `json:"minOrderValue"`
+	DutyRate        float64   `json:"dutyRate"`
+	ValidFrom       time.Time `json:"validFrom"`
+	ValidTo         time.Time `json:"validTo"`
+}
+
+//Eligibility of an order for a single trade agreement
+type agreementEligibility struct {
+	AgreementID string  `json:"agreementID"`
+	Name        string  `json:"name"`
+	Qualifies   bool    `json:"qualifies"`
+	DutyRate    float64 `json:"dutyRate"`
+	Reason      string  `json:"reason"`
+}
+
+//Preferential trade agreement determination stored with the COO record
+type preferenceDetermination struct {
+	EvaluationDate       time.Time              `json:"evaluationDate"`
+	QualifyingAgreements []string               `json:"qualifyingAgreements"`
+	Results              []agreementEligibility `json:"results"`
+}
+
+//Certificate of Origin issued for a compliant order
+type certificateOfOrigin struct {
+	ObjectType       string     `json:"objectType"`
+	CertID           string     `json:"certID"`
+	Content          cooContent `json:"content"`
+	Hash             string     `json:"hash"`
+	Status           string     `json:"status"`
+	RevokedBy        string     `json:"revokedBy"`
+	RevocationReason string     `json:"revocationReason"`
+	RevocationDate   time.Time  `json:"revocationDate"`
+}
+
+//Certified content of the Certificate of Origin - the hash is computed over its canonical JSON
+type cooContent struct {
+	CertID          string    `json:"certID"`
+	OrderID         string    `json:"orderID"`
+	Exporter        string    `json:"exporter"`
+	Importer        string    `json:"importer"`
+	Item            string    `json:"item"`
+	ItemDescription string    `json:"itemDescription"`
+	Quantity        int       `json:"quantity"`
+	SerialNumber    string    `json:"serialNumber"`
+	LotNumber       string    `json:"lotNumber"`
+	CountryOfOrigin string    `json:"countryOfOrigin"`
+	Destination     string    `json:"destination"`
+	IssuedBy        string    `json:"issuedBy"`
+	IssueDate       time.Time `json:"issueDate"`
+}
+
+//Result of verifying a Certificate of Origin against the ledger
+type cooVerification struct {
+	CertID      string `json:"certID"`
+	OrderID     string `json:"orderID"`
+	Status      string `json:"status"`
+	HashMatches bool   `json:"hashMatches"`
+	Valid       bool   `json:"valid"`
+	Message     string `json:"message"`
 }
 
 func (t *SimpleChainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
@@ -72,6 +149,20 @@ func (t *SimpleChainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.createCOORecord(stub, args)
 	} else if function == "queryCOORecord" {
 		return t.queryCOORecord(stub, args)
+	} else if function == "issueCOO" {
+		return t.issueCOO(stub, args)
+	} else if function == "revokeCOO" {
+		return t.revokeCOO(stub, args)
+	} else if function == "verifyCOO" {
+		return t.verifyCOO(stub, args)
+	} else if function == "queryCOORecords" {
+		return t.queryCOORecords(stub, args)
+	} else if function == "defineTradeAgreement" {
+		return t.defineTradeAgreement(stub, args)
+	} else if function == "queryTradeAgreements" {
+		return t.queryTradeAgreements(stub, args)
+	} else if function == "evaluatePreference" {
+		return t.evaluatePreference(stub, args)
 	} else {
 		return shim.Error("Invalid function name " + function)
 	}
@@ -159,6 +250,7 @@ func (t *SimpleChainCode) createCOORecord(stub shim.ChaincodeStubInterface, args
 	}
 
 	//Check if the transaction is Country Of Origin Compliant
+	cooCompliant := "No"
 	if strings.ToLower(countryOfOrigin) == "cuba" {
 		//notification = "The Shipment is not Country of Origin Compliant"
 		attr3 = countryOfOrigin + " is not in the approved list of countries for importing of goods"
@@ -179,7 +271,19 @@ func (t *SimpleChainCode) createCOORecord(stub shim.ChaincodeStubInterface, args
 		//notification = "The Shipment is Country of Origin Compliant"
 		attr3 = "The Shipment is Country of Origin Compliant"
 		attr5 = "{\"Country of Origin Compliant\":\"Yes\"}"
+		cooCompliant = "Yes"
+	}
+
+	//Record the time of verification
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
 	}
+	verificationDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	//Origin, destination or verdict may have changed, the preferential trade agreements must
+	//be determined again with evaluatePreference
+	var preference *preferenceDetermination
 
 	//Update event name
 	event = "Country of Origin Compliance Verification"
@@ -188,7 +292,7 @@ func (t *SimpleChainCode) createCOORecord(stub shim.ChaincodeStubInterface, args
 
 	//Update an order object
 	objectType := "sales order"
-	orderObj := &order{objectType, orderID, item, itemDesc, customer, manufacturer, shipper, supplier, quantity, event, expectedDeliveryDate, actualDeliveryDate, exception, documentType, attachment, workOrder, invoice, purchaseOrder, certification, reference, netAmount, unitPrice, charges, discount, tax, owner, custody, currentLoc, countryOfOrigin, destination, maxVib, temperature, notification, crossCountry, serialNum, lotNum, attr1, attr2, attr3, attr4, attr5, attr6, invalidTrx, count}
+	orderObj := &order{objectType, orderID, item, itemDesc, customer, manufacturer, shipper, supplier, quantity, event, expectedDeliveryDate, actualDeliveryDate, exception, documentType, attachment, workOrder, invoice, purchaseOrder, certification, reference, netAmount, unitPrice, charges, discount, tax, owner, custody, currentLoc, countryOfOrigin, destination, maxVib, temperature, notification, crossCountry, serialNum, lotNum, attr1, attr2, attr3, attr4, attr5, attr6, invalidTrx, count, cooCompliant, verificationDate, preference}
 
 	//Convert the order object to JSON object
 	orderBytes, err := json.Marshal(orderObj)
@@ -227,3 +331,589 @@ func (t *SimpleChainCode) queryCOORecord(stub shim.ChaincodeStubInterface, args
 	}
 	return shim.Success(orderBytes)
 }
+
+//===================================================================================
+//queryCOORecords - Rich query on COO Compliance records with pagination
+//Filters: verdict, origin, destination, customer, from date, to date (empty = any)
+//===================================================================================
+func (t *SimpleChainCode) queryCOORecords(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//Check if the number of arguments is 8
+	if len(args) != 8 {
+		return shim.Error("Incorrect number of arguments, expecting 8")
+	}
+	verdict := args[0]
+	origin := args[1]
+	destination := args[2]
+	customer := args[3]
+	fromDate := args[4]
+	toDate := args[5]
+	pageSize, err := strconv.Atoi(args[6])
+	if err != nil || pageSize <= 0 {
+		return shim.Error("Page size must be a positive number")
+	}
+	bookmark := args[7]
+
+	//Build the selector - values are marshalled as JSON so they cannot alter the query
+	selector := map[string]interface{}{
+		"objectType":   "sales order",
+		"cooCompliant": map[string]interface{}{"$exists": true},
+	}
+	if len(verdict) != 0 {
+		if verdict != "Yes" && verdict != "No" {
+			return shim.Error("Compliance verdict must be Yes or No")
+		}
+		selector["cooCompliant"] = verdict
+	}
+	if len(origin) != 0 {
+		selector["countryOfOrigin"] = origin
+	}
+	if len(destination) != 0 {
+		selector["destination"] = destination
+	}
+	if len(customer) != 0 {
+		selector["customer"] = customer
+	}
+	if len(fromDate) != 0 || len(toDate) != 0 {
+		dateRange := map[string]interface{}{}
+		if len(fromDate) != 0 {
+			from, err := parseQueryDate(fromDate)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			dateRange["$gte"] = from.Format(time.RFC3339Nano)
+		}
+		if len(toDate) != 0 {
+			to, err := parseQueryDate(toDate)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			//A date without time covers the whole day
+			if len(toDate) == len("2006-01-02") {
+				dateRange["$lt"] = to.AddDate(0, 0, 1).Format(time.RFC3339Nano)
+			} else {
+				dateRange["$lte"] = to.Format(time.RFC3339Nano)
+			}
+		}
+		selector["verificationDate"] = dateRange
+	}
+	queryBytes, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultsIterator, metadata, err := stub.GetQueryResultWithPagination(string(queryBytes), int32(pageSize), bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	//Write the records and the pagination details into a buffer
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("{\"records\":[")
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Value)
+		isRecordWritten = true
+	}
+	buffer.WriteString("],\"fetchedRecordsCount\":")
+	buffer.WriteString(strconv.Itoa(int(metadata.FetchedRecordsCount)))
+	buffer.WriteString(",\"bookmark\":\"")
+	buffer.WriteString(metadata.Bookmark)
+	buffer.WriteString("\"}")
+	return shim.Success(buffer.Bytes())
+}
+
+//==================================================================================================
+//defineTradeAgreement - Create or update a preferential trade agreement
+//Arguments: agreement ID, name, member countries, item prefixes, excluded items (comma separated),
+//minimum order value, preferential duty rate, valid from, valid to
+//==================================================================================================
+func (t *SimpleChainCode) defineTradeAgreement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//Check if the number of arguments is 9
+	if len(args) != 9 {
+		return shim.Error("Incorrect number of arguments, expecting 9")
+	}
+	agreementID := args[0]
+	name := args[1]
+	if len(agreementID) == 0 {
+		return shim.Error("Agreement ID cannot be null")
+	}
+	//Only compliance officers can maintain trade agreements
+	_, err := getComplianceOfficer(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	memberCountries := splitList(args[2])
+	if len(memberCountries) < 2 {
+		return shim.Error("Trade agreement needs at least 2 member countries")
+	}
+	itemPrefixes := splitList(args[3])
+	excludedItems := splitList(args[4])
+	minOrderValue, err := strconv.ParseFloat(args[5], 64)
+	if err != nil {
+		minOrderValue = 0
+	}
+	dutyRate, err := strconv.ParseFloat(args[6], 64)
+	if err != nil {
+		return shim.Error("Invalid duty rate " + args[6])
+	}
+	validFrom, err := parseQueryDate(args[7])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	//Agreement without end date is valid indefinitely
+	var validTo time.Time
+	if len(args[8]) != 0 {
+		validTo, err = parseQueryDate(args[8])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if validTo.Before(validFrom) {
+			return shim.Error("Valid to date cannot be before valid from date")
+		}
+		//A date without time covers the whole day, the stored end date is exclusive
+		if len(args[8]) == len("2006-01-02") {
+			validTo = validTo.AddDate(0, 0, 1)
+		}
+	}
+
+	objectType := "trade agreement"
+	agreementObj := &tradeAgreement{objectType, agreementID, name, memberCountries, itemPrefixes, excludedItems, minOrderValue, dutyRate, validFrom, validTo}
+	agreementBytes, err := json.Marshal(agreementObj)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	agreementKey, err := stub.CreateCompositeKey("tradeAgreement", []string{agreementID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(agreementKey, agreementBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(agreementBytes)
+}
+
+//=======================================================
+//queryTradeAgreements - List all defined trade agreements
+//=======================================================
+func (t *SimpleChainCode) queryTradeAgreements(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	agreementIterator, err := stub.GetStateByPartialCompositeKey("tradeAgreement", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer agreementIterator.Close()
+
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("[")
+	for agreementIterator.HasNext() {
+		response, err := agreementIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Value)
+		isRecordWritten = true
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+//==============================================================================================
+//evaluatePreference - Determine the trade agreements the order qualifies for and store the
+//result with the COO record
+//==============================================================================================
+func (t *SimpleChainCode) evaluatePreference(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//Check if the number of arguments is 1
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	orderID := args[0]
+
+	//Get the COO Compliance record of the order
+	orderBytes, err := stub.GetState(orderID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if orderBytes == nil {
+		return shim.Error("Invalid Order ID " + orderID)
+	}
+	orderObj := order{}
+	err = json.Unmarshal(orderBytes, &orderObj)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if orderObj.COOCompliant != "Yes" {
+		return shim.Error("Preference cannot be evaluated, the shipment is not Country of Origin Compliant")
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	evaluationDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	//Evaluate each trade agreement against origin, destination and item data
+	agreementIterator, err := stub.GetStateByPartialCompositeKey("tradeAgreement", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer agreementIterator.Close()
+	results := []agreementEligibility{}
+	qualifyingAgreements := []string{}
+	for agreementIterator.HasNext() {
+		response, err := agreementIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		agreementObj := tradeAgreement{}
+		err = json.Unmarshal(response.Value, &agreementObj)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		reason := checkPreferenceRules(agreementObj, orderObj, evaluationDate)
+		qualifies := reason == ""
+		if qualifies {
+			reason = "Shipment qualifies for preferential duty under " + agreementObj.Name
+			qualifyingAgreements = append(qualifyingAgreements, agreementObj.AgreementID)
+		}
+		results = append(results, agreementEligibility{agreementObj.AgreementID, agreementObj.Name, qualifies, agreementObj.DutyRate, reason})
+	}
+
+	//Store the determination with the COO record
+	orderObj.Preference = &preferenceDetermination{evaluationDate, qualifyingAgreements, results}
+	orderObj.Event = "Preferential Trade Agreement Evaluation"
+	orderBytes, err = json.Marshal(orderObj)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(orderID, orderBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	preferenceBytes, err := json.Marshal(orderObj.Preference)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.SetEvent(orderObj.Event, orderBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(preferenceBytes)
+}
+
+//Check the order against the rules of the trade agreement, returns the reason if it does not qualify
+func checkPreferenceRules(agreementObj tradeAgreement, orderObj order, evaluationDate time.Time) string {
+	if evaluationDate.Before(agreementObj.ValidFrom) || (!agreementObj.ValidTo.IsZero() && !evaluationDate.Before(agreementObj.ValidTo)) {
+		return "Trade agreement is not in force"
+	}
+	if !containsIgnoreCase(agreementObj.MemberCountries, orderObj.CountryOfOrigin) {
+		return orderObj.CountryOfOrigin + " is not a member country"
+	}
+	if !containsIgnoreCase(agreementObj.MemberCountries, orderObj.Destination) {
+		return orderObj.Destination + " is not a member country"
+	}
+	if containsIgnoreCase(agreementObj.ExcludedItems, orderObj.Item) {
+		return "Item " + orderObj.Item + " is excluded from the trade agreement"
+	}
+	if len(agreementObj.ItemPrefixes) != 0 {
+		isItemCovered := false
+		var i int
+		for i = 0; i < len(agreementObj.ItemPrefixes); i++ {
+			if strings.HasPrefix(strings.ToLower(orderObj.Item), strings.ToLower(agreementObj.ItemPrefixes[i])) {
+				isItemCovered = true
+				break
+			}
+		}
+		if !isItemCovered {
+			return "Item " + orderObj.Item + " is not covered by the trade agreement"
+		}
+	}
+	if orderObj.NetAmount < agreementObj.MinOrderValue {
+		return "Order value is below the minimum of " + strconv.FormatFloat(agreementObj.MinOrderValue, 'f', 2, 64)
+	}
+	return ""
+}
+
+//Split a comma separated list into trimmed, non-empty values
+func splitList(list string) []string {
+	values := []string{}
+	items := strings.Split(list, ",")
+	var i int
+	for i = 0; i < len(items); i++ {
+		item := strings.TrimSpace(items[i])
+		if len(item) != 0 {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+//Check if the list contains the value ignoring case
+func containsIgnoreCase(list []string, value string) bool {
+	var i int
+	for i = 0; i < len(list); i++ {
+		if strings.EqualFold(list[i], value) {
+			return true
+		}
+	}
+	return false
+}
+
+//Parse a query date given either as a date or as a timestamp
+func parseQueryDate(date string) (time.Time, error) {
+	queryDate, err := time.Parse("2006-01-02T15:04:05.000Z", date)
+	if err != nil {
+		queryDate, err = time.Parse("2006-01-02", date)
+		if err != nil {
+			return queryDate, fmt.Errorf("Invalid date %s, expecting YYYY-MM-DD", date)
+		}
+	}
+	return queryDate.UTC(), nil
+}
+
+//================================================================
+//issueCOO - Issue a Certificate of Origin for a compliant order
+//================================================================
+func (t *SimpleChainCode) issueCOO(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//Check if the number of arguments is 1
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	orderID := args[0]
+
+	//Only compliance officers can issue a certificate
+	issuedBy, err := getComplianceOfficer(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//Get the COO Compliance record of the order
+	orderBytes, err := stub.GetState(orderID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if orderBytes == nil {
+		return shim.Error("Invalid Order ID " + orderID)
+	}
+	orderObj := order{}
+	err = json.Unmarshal(orderBytes, &orderObj)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if orderObj.Attribute3 != "The Shipment is Country of Origin Compliant" {
+		return shim.Error("Certificate of Origin cannot be issued, " + orderObj.Attribute3)
+	}
+
+	//Only one active certificate is allowed per order
+	certIterator, err := stub.GetStateByPartialCompositeKey("cooCert", []string{orderID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer certIterator.Close()
+	for certIterator.HasNext() {
+		certRange, err := certIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, certKeys, err := stub.SplitCompositeKey(certRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		existingCert, err := getCOO(stub, certKeys[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if existingCert.Status == "Issued" {
+			return shim.Error("Certificate of Origin " + existingCert.CertID + " is already issued for order " + orderID)
+		}
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	issueDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	//Exporter is the party shipping the goods out of the country of origin
+	exporter := orderObj.Manufacturer
+	if len(orderObj.Supplier) != 0 {
+		exporter = orderObj.Supplier
+	}
+	certID := "COO-" + stub.GetTxID()
+	content := cooContent{certID, orderID, exporter, orderObj.Customer, orderObj.Item, orderObj.ItemDescription, orderObj.Quantity, orderObj.SerialNumber, orderObj.LotNumber, orderObj.CountryOfOrigin, orderObj.Destination, issuedBy, issueDate}
+	hash, err := getCOOHash(content)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	objectType := "certificate of origin"
+	certObj := &certificateOfOrigin{objectType, certID, content, hash, "Issued", "", "", time.Time{}}
+	certBytes, err := json.Marshal(certObj)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//Create Write Set
+	err = stub.PutState(certID, certBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	certKey, err := stub.CreateCompositeKey("cooCert", []string{orderID, certID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(certKey, []byte{0x00})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.SetEvent("Certificate of Origin Issued", certBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(certBytes)
+}
+
+//==================================================
+//revokeCOO - Revoke an issued Certificate of Origin
+//==================================================
+func (t *SimpleChainCode) revokeCOO(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//Check if the number of arguments is 2
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	certID := args[0]
+	reason := args[1]
+	if len(reason) == 0 {
+		return shim.Error("Revocation reason cannot be null")
+	}
+
+	//Only compliance officers can revoke a certificate
+	revokedBy, err := getComplianceOfficer(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	certObj, err := getCOO(stub, certID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if certObj.Status != "Issued" {
+		return shim.Error("Certificate of Origin " + certID + " is already " + certObj.Status)
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	certObj.Status = "Revoked"
+	certObj.RevokedBy = revokedBy
+	certObj.RevocationReason = reason
+	certObj.RevocationDate = time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	certBytes, err := json.Marshal(certObj)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(certID, certBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.SetEvent("Certificate of Origin Revoked", certBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(certBytes)
+}
+
+//=========================================================================
+//verifyCOO - Verify a Certificate of Origin and its hash against the ledger
+//=========================================================================
+func (t *SimpleChainCode) verifyCOO(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//Check if the number of arguments is 2
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	certID := args[0]
+	hash := strings.ToLower(args[1])
+
+	certObj, err := getCOO(stub, certID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//Recompute the hash from the certified content to detect tampering of the stored record
+	ledgerHash, err := getCOOHash(certObj.Content)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	verification := cooVerification{certID, certObj.Content.OrderID, certObj.Status, false, false, ""}
+	verification.HashMatches = ledgerHash == certObj.Hash && hash == certObj.Hash
+	if !verification.HashMatches {
+		verification.Message = "Certificate hash does not match the ledger record"
+	} else if certObj.Status != "Issued" {
+		verification.Message = "Certificate of Origin has been revoked: " + certObj.RevocationReason
+	} else {
+		verification.Valid = true
+		verification.Message = "Certificate of Origin is valid"
+	}
+
+	verificationBytes, err := json.Marshal(verification)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(verificationBytes)
+}
+
+//Get the Certificate of Origin for the certificate ID
+func getCOO(stub shim.ChaincodeStubInterface, certID string) (certificateOfOrigin, error) {
+	certObj := certificateOfOrigin{}
+	certBytes, err := stub.GetState(certID)
+	if err != nil {
+		return certObj, err
+	} else if certBytes == nil {
+		return certObj, fmt.Errorf("Invalid Certificate ID %s", certID)
+	}
+	err = json.Unmarshal(certBytes, &certObj)
+	return certObj, err
+}
+
+//Compute the SHA-256 hash of the canonical JSON of the certificate content
+func getCOOHash(content cooContent) (string, error) {
+	contentBytes, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(contentBytes)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+//Return the identity of the invoker as MSP ID and certificate ID
+func getInvokerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "::" + id, nil
+}
+
+//Return the identity of the invoker, who must carry the complianceOfficer role attribute
+func getComplianceOfficer(stub shim.ChaincodeStubInterface) (string, error) {
+	err := cid.AssertAttributeValue(stub, "role", "complianceOfficer")
+	if err != nil {
+		return "", fmt.Errorf("Caller is not an authorized compliance officer: %s", err.Error())
+	}
+	return getInvokerIdentity(stub)
+}
@@ -7,10 +7,12 @@ import (
 	"fmt"
 
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/protos/peer"
 )
@@ -29,34 +31,230 @@ type revenueShare struct {
 	RevenueCurrency string  `json:"revenueCurrency"`
 	Stakeholder1Rev float64 `json:"stakeholder1rev"`
 	Stakeholder2Rev float64 `json:"stakeholder2rev"`
+	AgreementID     string  `json:"agreementID"`
+	//Revenue shares converted to the reporting currency of each stakeholder
+	Stakeholder1Currency     string    `json:"stakeholder1Currency"`
+	Stakeholder1RevConverted float64   `json:"stakeholder1revConverted"`
+	Stakeholder2Currency     string    `json:"stakeholder2Currency"`
+	Stakeholder2RevConverted float64   `json:"stakeholder2revConverted"`
+	FxRateDate               time.Time `json:"fxRateDate"`
+}
+type revenueShareAgreement struct {
+	ObjectType             string    `json:"objectType"`
+	AgreementID            string    `json:"agreementID"`
+	BookingProduct         string    `json:"bookingProduct"`
+	FulfillingProduct      string    `json:"fulfillingProduct"`
+	EventType              string    `json:"eventType"`
+	Stakeholder1Percentage float64   `json:"stakeholder1Percentage"`
+	Stakeholder2Percentage float64   `json:"stakeholder2Percentage"`
+	FixedFee               float64   `json:"fixedFee"`
+	ValidFrom              time.Time `json:"validFrom"`
+	ValidTo                time.Time `json:"validTo"`
 }
 type tripDetails struct {
-	ObjectType               string         `json:"objectType"`
-	TktID                    string         `json:"tktID"`
-	FromLOC                  string         `json:"fromLOC"`
-	ToLOC                    string         `json:"toLOC"`
-	RiderID                  string         `json:"riderID"`
-	Products                 string         `json:"products"`
-	Price                    float64        `json:"price"`
-	Currency                 string         `json:"currency"`
-	Progress                 string         `json:"progress"`
-	Status                   string         `json:"status"`
-	HasBookedUsingSegment    bool           `json:"hasBookesUsingSegment"`
-	HasFulfilledUsingSegment bool           `json:"hasFulfilledUsingSegment"`
-	BookedUsingProduct       string         `json:"bookedUsingProduct"`
-	Event                    string         `json:"event"`
-	SeqNo                    int            `json:"seqNo"`
-	Duration                 string         `json:"duration"`
-	CreationDate             time.Time      `json:"creationDate"`
-	Geography                string         `json:"geography"`
-	RevenueSharing           []revenueShare `json:"revenuesharing"`
-	RevenueEarned            float64        `json:"revenueEarned"`
+	ObjectType               string           `json:"objectType"`
+	TktID                    string           `json:"tktID"`
+	FromLOC                  string           `json:"fromLOC"`
+	ToLOC                    string           `json:"toLOC"`
+	RiderID                  string           `json:"riderID"`
+	Products                 string           `json:"products"`
+	Price                    float64          `json:"price"`
+	Currency                 string           `json:"currency"`
+	Progress                 string           `json:"progress"`
+	Status                   string           `json:"status"`
+	HasBookedUsingSegment    bool             `json:"hasBookesUsingSegment"`
+	HasFulfilledUsingSegment bool             `json:"hasFulfilledUsingSegment"`
+	BookedUsingProduct       string           `json:"bookedUsingProduct"`
+	Event                    string           `json:"event"`
+	SeqNo                    int              `json:"seqNo"`
+	Duration                 string           `json:"duration"`
+	CreationDate             time.Time        `json:"creationDate"`
+	Geography                string           `json:"geography"`
+	RevenueSharing           []revenueShare   `json:"revenuesharing"`
+	RevenueEarned            float64          `json:"revenueEarned"`
+	RevenueEarnedCurrency    string           `json:"revenueEarnedCurrency"`
+	DepartureTime            time.Time        `json:"departureTime"`
+	CancellationReason       string           `json:"cancellationReason"`
+	RefundAmount             float64          `json:"refundAmount"`
+	CancellationDate         time.Time        `json:"cancellationDate"`
+	TicketNumber             string           `json:"ticketNumber"`
+	Transitions              []tripTransition `json:"transitions"`
+	DiscountAmount           float64          `json:"discountAmount"`
+}
+type tripTransition struct {
+	FromStatus     string    `json:"fromStatus"`
+	ToStatus       string    `json:"toStatus"`
+	Event          string    `json:"event"`
+	TxID           string    `json:"txID"`
+	TransitionDate time.Time `json:"transitionDate"`
+}
+type tripSegment struct {
+	ObjectType         string    `json:"objectType"`
+	TktID              string    `json:"tktID"`
+	SegmentID          string    `json:"segmentID"`
+	SeqNo              int       `json:"seqNo"`
+	Operator           string    `json:"operator"`
+	Mode               string    `json:"mode"`
+	FromLOC            string    `json:"fromLOC"`
+	ToLOC              string    `json:"toLOC"`
+	ScheduledDeparture time.Time `json:"scheduledDeparture"`
+	ScheduledArrival   time.Time `json:"scheduledArrival"`
+	ActualDeparture    time.Time `json:"actualDeparture"`
+	ActualArrival      time.Time `json:"actualArrival"`
+	Price              float64   `json:"price"`
+	Currency           string    `json:"currency"`
+	Status             string    `json:"status"`
+	Event              string    `json:"event"`
+	CompletedDate      time.Time `json:"completedDate"`
+}
+type location struct {
+	ObjectType   string  `json:"objectType"`
+	LocationID   string  `json:"locationID"`
+	Name         string  `json:"name"`
+	LocationType string  `json:"locationType"`
+	City         string  `json:"city"`
+	Country      string  `json:"country"`
+	Region       string  `json:"region"`
+	Latitude     float64 `json:"latitude"`
+	Longitude    float64 `json:"longitude"`
+}
+type offer struct {
+	ObjectType       string        `json:"objectType"`
+	OfferID          string        `json:"offerID"`
+	Operator         string        `json:"operator"`
+	Description      string        `json:"description"`
+	EligibleProducts []string      `json:"eligibleProducts"`
+	MinTripPrice     float64       `json:"minTripPrice"`
+	PointsRequired   int           `json:"pointsRequired"`
+	Discount         float64       `json:"discount"`
+	Currency         string        `json:"currency"`
+	ExpiryDate       time.Time     `json:"expiryDate"`
+	Budget           float64       `json:"budget"`
+	BudgetUsed       float64       `json:"budgetUsed"`
+	Funders          []offerFunder `json:"funders"`
+}
+type offerFunder struct {
+	Operator        string  `json:"operator"`
+	SharePercentage float64 `json:"sharePercentage"`
+}
+type offerRedemption struct {
+	ObjectType     string        `json:"objectType"`
+	OfferID        string        `json:"offerID"`
+	TktID          string        `json:"tktID"`
+	RiderID        string        `json:"riderID"`
+	Discount       float64       `json:"discount"`
+	Currency       string        `json:"currency"`
+	PointsDebited  int           `json:"pointsDebited"`
+	FundedShares   []offerFunded `json:"fundedShares"`
+	RedemptionDate time.Time     `json:"redemptionDate"`
+}
+type offerFunded struct {
+	Operator     string  `json:"operator"`
+	FundedAmount float64 `json:"fundedAmount"`
+}
+type offerFunding struct {
+	ObjectType      string  `json:"objectType"`
+	Operator        string  `json:"operator"`
+	OfferID         string  `json:"offerID"`
+	Currency        string  `json:"currency"`
+	FundedAmount    float64 `json:"fundedAmount"`
+	NoOfRedemptions int     `json:"noOfRedemptions"`
+}
+type loyaltyProgram struct {
+	ObjectType       string  `json:"objectType"`
+	PointsPerSegment int     `json:"pointsPerSegment"`
+	PointsPerUnit    float64 `json:"pointsPerUnit"`
+}
+type loyaltyAccount struct {
+	ObjectType     string `json:"objectType"`
+	RiderID        string `json:"riderID"`
+	Points         int    `json:"points"`
+	PointsAccrued  int    `json:"pointsAccrued"`
+	PointsRedeemed int    `json:"pointsRedeemed"`
+}
+type richQuery struct {
+	Fields     []string
+	Conditions []queryCondition
+}
+type queryCondition struct {
+	Field    string
+	Operator string
+	Value    string
 }
 type KPI struct {
-	NoOfOrgs  int     `json:"noOfOrgs"`
-	Revenue   float64 `json:"revenue"`
-	Cost      float64 `json:"cost"`
-	NoOfTrips int     `json:"noOfTrips"`
+	NoOfOrgs          int         `json:"noOfOrgs"`
+	Revenue           float64     `json:"revenue"`
+	Cost              float64     `json:"cost"`
+	NoOfTrips         int         `json:"noOfTrips"`
+	ReportingCurrency string      `json:"reportingCurrency"`
+	ReportingPeriod   string      `json:"reportingPeriod"`
+	Periods           []kpiPeriod `json:"periods"`
+}
+type kpiPeriod struct {
+	Period      string    `json:"period"`
+	PeriodStart time.Time `json:"periodStart"`
+	Revenue     float64   `json:"revenue"`
+	Cost        float64   `json:"cost"`
+	NoOfTrips   int       `json:"noOfTrips"`
+}
+type kpiParameters struct {
+	ObjectType      string        `json:"objectType"`
+	Stakeholder     string        `json:"stakeholder"`
+	CostRatio       float64       `json:"costRatio"`
+	FixedCosts      []kpiCostLine `json:"fixedCosts"`
+	ReportingPeriod string        `json:"reportingPeriod"`
+}
+type kpiCostLine struct {
+	Description string  `json:"description"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+}
+type stakeholder struct {
+	ObjectType     string    `json:"objectType"`
+	StakeholderID  string    `json:"stakeholderID"`
+	Name           string    `json:"name"`
+	RegisteredDate time.Time `json:"registeredDate"`
+}
+type settlement struct {
+	ObjectType      string           `json:"objectType"`
+	SettlementID    string           `json:"settlementID"`
+	PeriodStart     time.Time        `json:"periodStart"`
+	PeriodEnd       time.Time        `json:"periodEnd"`
+	Status          string           `json:"status"`
+	Lines           []settlementLine `json:"lines"`
+	Acknowledgments []settlementAck  `json:"acknowledgments"`
+	GeneratedDate   time.Time        `json:"generatedDate"`
+	PaidDate        time.Time        `json:"paidDate"`
+}
+type settlementLine struct {
+	Payer        string  `json:"payer"`
+	Payee        string  `json:"payee"`
+	Currency     string  `json:"currency"`
+	GrossPayable float64 `json:"grossPayable"`
+	GrossOffset  float64 `json:"grossOffset"`
+	NetAmount    float64 `json:"netAmount"`
+	NoOfShares   int     `json:"noOfShares"`
+}
+type settlementAck struct {
+	Stakeholder     string    `json:"stakeholder"`
+	AcknowledgedBy  string    `json:"acknowledgedBy"`
+	AcknowledgeDate time.Time `json:"acknowledgeDate"`
+}
+type refundPolicy struct {
+	ObjectType               string       `json:"objectType"`
+	Tiers                    []refundTier `json:"tiers"`
+	UsedSegmentDeductionPerc float64      `json:"usedSegmentDeductionPerc"`
+}
+type refundTier struct {
+	MinHoursBeforeDeparture float64 `json:"minHoursBeforeDeparture"`
+	RefundPercentage        float64 `json:"refundPercentage"`
+}
+type fxRate struct {
+	ObjectType    string    `json:"objectType"`
+	Base          string    `json:"base"`
+	Quote         string    `json:"quote"`
+	Rate          float64   `json:"rate"`
+	EffectiveDate time.Time `json:"effectiveDate"`
 }
 
 //=============
@@ -95,6 +293,68 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response
 		return t.queryTripsByStakeholder(stub, args)
 	} else if function == "queryTripsByRider" {
 		return t.queryTripsByRider(stub, args)
+	} else if function == "createRevenueShareAgreement" {
+		return t.createRevenueShareAgreement(stub, args)
+	} else if function == "queryRevenueShareAgreements" {
+		return t.queryRevenueShareAgreements(stub, args)
+	} else if function == "setFxRate" {
+		return t.setFxRate(stub, args)
+	} else if function == "queryFxRate" {
+		return t.queryFxRate(stub, args)
+	} else if function == "setReportingCurrency" {
+		return t.setReportingCurrency(stub, args)
+	} else if function == "generateSettlement" {
+		return t.generateSettlement(stub, args)
+	} else if function == "acknowledgeSettlement" {
+		return t.acknowledgeSettlement(stub, args)
+	} else if function == "markSettlementPaid" {
+		return t.markSettlementPaid(stub, args)
+	} else if function == "querySettlement" {
+		return t.querySettlement(stub, args)
+	} else if function == "setRefundPolicy" {
+		return t.setRefundPolicy(stub, args)
+	} else if function == "cancelTrip" {
+		return t.cancelTrip(stub, args)
+	} else if function == "queryTripByTicketNumber" {
+		return t.queryTripByTicketNumber(stub, args)
+	} else if function == "addSegment" {
+		return t.addSegment(stub, args)
+	} else if function == "updateSegment" {
+		return t.updateSegment(stub, args)
+	} else if function == "querySegments" {
+		return t.querySegments(stub, args)
+	} else if function == "registerLocation" {
+		return t.registerLocation(stub, args)
+	} else if function == "queryLocations" {
+		return t.queryLocations(stub, args)
+	} else if function == "queryTripsByGeography" {
+		return t.queryTripsByGeography(stub, args)
+	} else if function == "registerStakeholder" {
+		return t.registerStakeholder(stub, args)
+	} else if function == "queryStakeholders" {
+		return t.queryStakeholders(stub, args)
+	} else if function == "setKPIParameters" {
+		return t.setKPIParameters(stub, args)
+	} else if function == "queryKPIParameters" {
+		return t.queryKPIParameters(stub, args)
+	} else if function == "setLoyaltyProgram" {
+		return t.setLoyaltyProgram(stub, args)
+	} else if function == "queryLoyaltyAccount" {
+		return t.queryLoyaltyAccount(stub, args)
+	} else if function == "defineOffer" {
+		return t.defineOffer(stub, args)
+	} else if function == "queryOffers" {
+		return t.queryOffers(stub, args)
+	} else if function == "redeemOffer" {
+		return t.redeemOffer(stub, args)
+	} else if function == "queryOfferFunding" {
+		return t.queryOfferFunding(stub, args)
+	} else if function == "setQueryDialect" {
+		return t.setQueryDialect(stub, args)
+	} else if function == "getAllowedTripTransitions" {
+		return t.getAllowedTripTransitions(stub, args)
+	} else if function == "markTripRefunded" {
+		return t.markTripRefunded(stub, args)
 	} else {
 		return shim.Error("Invalid function name " + function)
 	}
@@ -132,60 +392,78 @@ func (t *SimpleChaincode) createTrip(stub shim.ChaincodeStubInterface, args []st
 		return shim.Error("Error 8 " + err.Error())
 	}
 	duration := args[14]
+	//Departure time is optional and is used by the refund policy
+	var departureTime time.Time
+	if len(args) > 15 && args[15] != "" {
+		departureTime, err = time.Parse(time.RFC3339, args[15])
+		if err != nil {
+			return shim.Error("Error 11 " + err.Error())
+		}
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
 	//Determine the new trip ID
-	//Last trip ID is stored as separate key in the ledger. If the key exists, increment the value
+	//The trip ID is derived from the transaction so that concurrent bookings do not share a counter key
+	var ticketNumber string
 	if tktID == "eTkt100" || tktID == "eTkt076" {
 		tktID = args[12]
+		ticketNumber = tktID
 	} else {
-		tripIDCurrentBytes, err := stub.GetState("LatestTripID")
+		txID := stub.GetTxID()
+		tktID = "TKT" + strconv.FormatInt(txTimestamp.Seconds, 10) + "-" + txID
+		//Human-friendly ticket number is the shortest unused prefix of the transaction ID
+		ticketNumber, err = getTicketNumber(stub, txID)
 		if err != nil {
-			return shim.Error("Error 3 " + err.Error())
-		}
-		var tripCounter int
-		if tripIDCurrentBytes == nil {
-			tripCounter = 001
-		} else {
-			tripCounterStr := string(tripIDCurrentBytes)
-			tripCounter, err = strconv.Atoi(tripCounterStr)
-			if err != nil {
-				return shim.Error("Error 4 " + err.Error())
-			}
-			tripCounter = tripCounter + 1
+			return shim.Error("Error 4 " + err.Error())
 		}
-
-		tktID = "e-Ticket" + strconv.Itoa(tripCounter)
-		err = stub.PutState("LatestTripID", []byte(strconv.Itoa(tripCounter)))
+		ticketKey, err := stub.CreateCompositeKey("ticketNumber", []string{ticketNumber})
 		if err != nil {
 			return shim.Error("Error 9 " + err.Error())
 		}
+		err = stub.PutState(ticketKey, []byte(tktID))
+		if err != nil {
+			return shim.Error("Error 12 " + err.Error())
+		}
 	}
 
-	//Determine the trip date
-	var creationDate time.Time
+	//Determine the trip date from the transaction so that all endorsers agree on it
+	creationDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
 	if tktID == "eTkt100" {
-		creationDate = time.Now().AddDate(0, 0, -2)
+		creationDate = creationDate.AddDate(0, 0, -2)
 	} else if tktID == "eTkt076" {
-		creationDate = time.Now().AddDate(0, 0, -1)
-	} else {
-		creationDate = time.Now()
+		creationDate = creationDate.AddDate(0, 0, -1)
 	}
 
-	//Determine Geography
-	var geography string
-	if strings.Contains(toLOC, "USA") {
-		geography = "US"
-	} else if strings.Contains(toLOC, "Amsterdam") || strings.Contains(toLOC, "London") {
-		geography = "Europe"
-	} else {
-		geography = "Worldwide"
+	//Determine Geography from the location registry
+	geography, err := getTripGeography(stub, fromLOC, toLOC)
+	if err != nil {
+		return shim.Error("Error 13 " + err.Error())
 	}
 
 	//Assign null value to revenue sharing
 	revShare := []revenueShare{}
 	//Assign null value to revenue earned
 	revenueEarned := 0.00
+	//Revenue earned is accumulated in the reporting currency of the booking stakeholder
+	revenueEarnedCurrency, err := getReportingCurrency(stub, bookedUsingProduct, currency)
+	if err != nil {
+		return shim.Error("Error 10 " + err.Error())
+	}
+	//Every trip starts its lifecycle as booked
+	if status != "" && normalizeTripStatus(status) != "Booked" {
+		return shim.Error("A trip must be created with status Booked")
+	}
+	status = "Booked"
+	progress = status
+	transition, err := newTripTransition(stub, "", status, event)
+	if err != nil {
+		return shim.Error("Error 14 " + err.Error())
+	}
+	transitions := []tripTransition{transition}
 	objectType := "Trips"
-	tripObj := &tripDetails{objectType, tktID, fromLOC, toLOC, riderID, products, price, currency, progress, status, hasBookedUsingSegment, hasFulfilledUsingSegment, bookedUsingProduct, event, seqNo, duration, creationDate, geography, revShare, revenueEarned}
+	tripObj := &tripDetails{objectType, tktID, fromLOC, toLOC, riderID, products, price, currency, progress, status, hasBookedUsingSegment, hasFulfilledUsingSegment, bookedUsingProduct, event, seqNo, duration, creationDate, geography, revShare, revenueEarned, revenueEarnedCurrency, departureTime, "", 0, time.Time{}, ticketNumber, transitions, 0}
 	tripBytes, err := json.Marshal(tripObj)
 	if err != nil {
 
@@ -210,14 +488,10 @@ func (t *SimpleChaincode) createTrip(stub shim.ChaincodeStubInterface, args []st
 //============================================
 func (t *SimpleChaincode) updateTrip(stub shim.ChaincodeStubInterface, args []string) peer.Response {
 	//Check if ticket ID exists in the system
-	tktID := args[12]
-	tripBytes, err := stub.GetState(tktID)
+	tktID, tripBytes, err := getTrip(stub, args[12])
 	if err != nil {
 		return shim.Error("Error 1 " + err.Error())
 	}
-	if tripBytes == nil {
-		return shim.Error("Trip ID " + tktID + " does not exist in the system")
-	}
 	fromLOC := args[0]
 	toLOC := args[1]
 	riderID := args[2]
@@ -245,27 +519,15 @@ func (t *SimpleChaincode) updateTrip(stub shim.ChaincodeStubInterface, args []st
 	}
 	duration := args[14]
 
-	//Determine the trip date
-	var creationDate time.Time
-	if tktID == "eTkt100" {
-		creationDate = time.Now().AddDate(0, 0, -2)
-	} else if tktID == "eTkt076" {
-		creationDate = time.Now().AddDate(0, 0, -1)
-	} else {
-		creationDate = time.Now()
-	}
-	//Determine Geography
-	var geography string
-	if strings.Contains(toLOC, "USA") {
-		geography = "US"
-	} else if strings.Contains(toLOC, "Amsterdam") || strings.Contains(toLOC, "London") {
-		geography = "Europe"
-	} else {
-		geography = "Worldwide"
+	//Determine Geography from the location registry
+	geography, err := getTripGeography(stub, fromLOC, toLOC)
+	if err != nil {
+		return shim.Error("Error 16 " + err.Error())
 	}
 	//Calculate revenue if Payment has been made
 	var revShare []revenueShare
 	var revenueEarned float64
+	var revenueEarnedCurrency string
 	var segmentPrice float64
 	segmentPrice = 0.00
 	tripObject := &tripDetails{}
@@ -273,17 +535,36 @@ func (t *SimpleChaincode) updateTrip(stub shim.ChaincodeStubInterface, args []st
 	if err != nil {
 		return shim.Error("Error 5 " + err.Error())
 	}
-	if event == "Payment Completed" {
-		tripIterator, err := stub.GetHistoryForKey(tktID)
+	//A cancelled trip cannot be updated
+	if isTripCancelled(tripObject.Status) {
+		return shim.Error("Trip ID " + tktID + " has been cancelled")
+	}
+	//The trip date is set once when the trip is created
+	creationDate := tripObject.CreationDate
+	//Cancellation and refund go through cancelTrip and markTripRefunded so that the
+	//segments, revenue reversals and refund amount are recorded with the status
+	if isTripCancelled(status) {
+		return shim.Error("Trip ID " + tktID + " can only be moved to status " + normalizeTripStatus(status) + " through cancelTrip or markTripRefunded")
+	}
+	//Status can only move along the allowed transitions of the trip lifecycle
+	if status != "" {
+		err = transitionTrip(stub, tripObject, status, event)
 		if err != nil {
-			return shim.Error("Error 8 " + err.Error())
+			return shim.Error("Error 17 " + err.Error())
 		}
-		defer tripIterator.Close()
-		//products = ""
-		var i int
-		isWritten := false
+	}
+	status = tripObject.Status
+	progress = tripObject.Progress
+	if event == "Payment Completed" {
 		revShare = tripObject.RevenueSharing
 		revenueEarned = tripObject.RevenueEarned
+		revenueEarnedCurrency = tripObject.RevenueEarnedCurrency
+		if revenueEarnedCurrency == "" {
+			revenueEarnedCurrency, err = getReportingCurrency(stub, tripObject.BookedUsingProduct, tripObject.Currency)
+			if err != nil {
+				return shim.Error("Error 15 " + err.Error())
+			}
+		}
 		//If this is one of the 2 default tickets, update the data differently
 		if tktID == "eTkt100" || tktID == "eTkt076" {
 			tripID := tktID
@@ -298,89 +579,86 @@ func (t *SimpleChaincode) updateTrip(stub shim.ChaincodeStubInterface, args []st
 			if err != nil {
 				return shim.Error("Error 11 " + err.Error())
 			}
-			revShareObj := revenueShare{tripID, fulfilledBy, stakeholder1, stakeholder2, tripRevenue, revCurrency, tripRevenue, tripRevenue}
+			revShareObj := revenueShare{tripID, fulfilledBy, stakeholder1, stakeholder2, tripRevenue, revCurrency, tripRevenue, tripRevenue, "", revCurrency, tripRevenue, revCurrency, tripRevenue, creationDate}
 			revShare = append(revShare, revShareObj)
 		} else {
-
-			for i = 0; tripIterator.HasNext(); i++ {
-				tripResponse, err := tripIterator.Next()
+			segments, err := getTripSegments(stub, tktID)
+			if err != nil {
+				return shim.Error("Error 8 " + err.Error())
+			}
+			//Calculate revenue sharing from the completed segments of the trip
+			var i int
+			isWritten := false
+			for i = 0; i < len(segments); i++ {
+				if segments[i].Status != "Completed" || segments[i].Price == 0 {
+					continue
+				}
+				revShareObj, revenueEarnedRev, err := calculateRevenueShare(stub, tktID, tripObject.BookedUsingProduct, segments[i].Operator, segments[i].Event, segments[i].Price, segments[i].Currency, revenueEarnedCurrency, segments[i].CompletedDate)
 				if err != nil {
-					return shim.Error("Error 9 " + err.Error())
+					return shim.Error("Error 14 " + err.Error())
+				}
+				revShare = append(revShare, revShareObj)
+				segmentPrice = segmentPrice + revShareObj.TripRevenue
+				revenueEarned = math.Round((revenueEarned+revenueEarnedRev)*100) / 100
+				if isWritten == true {
+					products = products + ", " + segments[i].Operator
+				} else {
+					products = segments[i].Operator
+					isWritten = true
 				}
-				tripRespBytes := tripResponse.Value
-				tripRespObj := &tripDetails{}
-				err = json.Unmarshal(tripRespBytes, tripRespObj)
+			}
+			//Trips recorded before segment records were introduced are shared from the trip history
+			if len(segments) == 0 {
+				tripIterator, err := stub.GetHistoryForKey(tktID)
 				if err != nil {
-					return shim.Error("Error 10 " + err.Error())
+					return shim.Error("Error 9 " + err.Error())
 				}
-
-				//Calculate revenue sharing if one of these events are part of trip history
-				if tripRespObj.Event == "Segment Completed" || tripRespObj.Event == "Segment Updated" || tripRespObj.Event == "Trip Completed" || tripRespObj.Event == "Offer Redeemed" {
-					if tripRespObj.Price == 0 {
-						continue
-					}
-					tripID := tripRespObj.TktID
-					fulfilledBy := tripRespObj.Products
-					stakeholder1 := tripRespObj.BookedUsingProduct
-					stakeholder2 := tripRespObj.Products
-					tripRevenue := tripRespObj.Price
-					revCurrency := tripRespObj.Currency
-					segmentPrice = segmentPrice + tripRevenue
-					//Calculate stakeholder revenue share only if booked by and fulfilled by parties are different
-					var stakeholder1Rev, stakeholder2Rev float64
-					if tripRespObj.BookedUsingProduct == tripRespObj.Products {
-						stakeholder1Rev = tripRevenue
-						stakeholder2Rev = tripRevenue
-					} else {
-						if tripRespObj.Event == "Offer Redeemed" {
-							stakeholder1Rev = 0.2 * tripRevenue
-							stakeholder2Rev = 0.8 * tripRevenue
-						} else {
-							stakeholder1Rev = 0.1 * tripRevenue
-							stakeholder2Rev = 0.9 * tripRevenue
-						}
+				defer tripIterator.Close()
+				for i = 0; tripIterator.HasNext(); i++ {
+					tripResponse, err := tripIterator.Next()
+					if err != nil {
+						return shim.Error("Error 10 " + err.Error())
 					}
-					stakeholder1RevString := strconv.FormatFloat(stakeholder1Rev, 'f', 2, 64)
-					stakeholder2RevString := strconv.FormatFloat(stakeholder2Rev, 'f', 2, 64)
-					stakeholder1Rev, err = strconv.ParseFloat(stakeholder1RevString, 64)
+					tripRespObj := &tripDetails{}
+					err = json.Unmarshal(tripResponse.Value, tripRespObj)
 					if err != nil {
 						return shim.Error("Error 11 " + err.Error())
 					}
-					stakeholder2Rev, err = strconv.ParseFloat(stakeholder2RevString, 64)
+					//Calculate revenue sharing if one of these events are part of trip history
+					if tripRespObj.Event != "Segment Completed" && tripRespObj.Event != "Segment Updated" && tripRespObj.Event != "Trip Completed" && tripRespObj.Event != "Offer Redeemed" {
+						continue
+					}
+					if tripRespObj.Price == 0 {
+						continue
+					}
+					eventDate := time.Unix(tripResponse.Timestamp.Seconds, int64(tripResponse.Timestamp.Nanos)).UTC()
+					revShareObj, revenueEarnedRev, err := calculateRevenueShare(stub, tripRespObj.TktID, tripRespObj.BookedUsingProduct, tripRespObj.Products, tripRespObj.Event, tripRespObj.Price, tripRespObj.Currency, revenueEarnedCurrency, eventDate)
 					if err != nil {
 						return shim.Error("Error 12 " + err.Error())
 					}
-					tripRevenueString := strconv.FormatFloat(tripRevenue, 'f', 2, 64)
-					tripRevenue, err = strconv.ParseFloat(tripRevenueString, 64)
-					revShareObj := revenueShare{tripID, fulfilledBy, stakeholder1, stakeholder2, tripRevenue, revCurrency, stakeholder1Rev, stakeholder2Rev}
 					revShare = append(revShare, revShareObj)
-					revenueEarned = revenueEarned + stakeholder1Rev
-					revenueEarnedString := strconv.FormatFloat(revenueEarned, 'f', 2, 64)
-					revenueEarned, err = strconv.ParseFloat(revenueEarnedString, 64)
-					if err != nil {
-						return shim.Error("Error 13 " + err.Error())
-					}
+					segmentPrice = segmentPrice + revShareObj.TripRevenue
+					revenueEarned = math.Round((revenueEarned+revenueEarnedRev)*100) / 100
 					if isWritten == true {
 						products = products + ", " + tripRespObj.Products
 					} else {
 						products = tripRespObj.Products
 						isWritten = true
 					}
-				} else {
-					continue
 				}
-
 			}
 		}
-		price = segmentPrice
+		//Discounts of redeemed offers are deducted from the price paid
+		price = math.Max(segmentPrice-tripObject.DiscountAmount, 0)
 		event = "Trip Payment based Revenue Sharing"
 	} else {
 
 		revShare = tripObject.RevenueSharing
 		revenueEarned = tripObject.RevenueEarned
+		revenueEarnedCurrency = tripObject.RevenueEarnedCurrency
 	}
 	objectType := "Trips"
-	tripObj := &tripDetails{objectType, tktID, fromLOC, toLOC, riderID, products, price, currency, progress, status, hasBookedUsingSegment, hasFulfilledUsingSegment, bookedUsingProduct, event, seqNo, duration, creationDate, geography, revShare, revenueEarned}
+	tripObj := &tripDetails{objectType, tktID, fromLOC, toLOC, riderID, products, price, currency, progress, status, hasBookedUsingSegment, hasFulfilledUsingSegment, bookedUsingProduct, event, seqNo, duration, creationDate, geography, revShare, revenueEarned, revenueEarnedCurrency, tripObject.DepartureTime, "", 0, time.Time{}, tripObject.TicketNumber, tripObject.Transitions, tripObject.DiscountAmount}
 	tripNewBytes, err := json.Marshal(tripObj)
 	if err != nil {
 
@@ -396,6 +674,210 @@ func (t *SimpleChaincode) updateTrip(stub shim.ChaincodeStubInterface, args []st
 
 }
 
+//====================================================================================================
+//createRevenueShareAgreement - Function to create revenue sharing agreement between trip stakeholders
+//Arguments: agreement ID, booking product, fulfilling product, event type, booking stakeholder %,
+//fulfilling stakeholder %, fixed fee paid to booking stakeholder, valid from, valid to
+//====================================================================================================
+func (t *SimpleChaincode) createRevenueShareAgreement(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 9 {
+		return shim.Error("Incorrect number of arguments, expecting 9")
+	}
+	//Only administrators can define revenue sharing agreements
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	agreementID := args[0]
+	bookingProduct := args[1]
+	fulfillingProduct := args[2]
+	eventType := args[3]
+	if agreementID == "" || bookingProduct == "" || fulfillingProduct == "" || eventType == "" {
+		return shim.Error("Agreement ID, booking product, fulfilling product and event type cannot be null")
+	}
+	stakeholder1Percentage, err := strconv.ParseFloat(args[4], 64)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	stakeholder2Percentage, err := strconv.ParseFloat(args[5], 64)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	if stakeholder1Percentage < 0 || stakeholder2Percentage < 0 || math.Abs(stakeholder1Percentage+stakeholder2Percentage-100) > 0.001 {
+		return shim.Error("Revenue share percentages must add up to 100")
+	}
+	fixedFee, err := strconv.ParseFloat(args[6], 64)
+	if err != nil {
+		fixedFee = 0
+	}
+	validFrom, err := time.Parse("2006-01-02", args[7])
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	//Agreement without end date is valid indefinitely
+	var validTo time.Time
+	if args[8] != "" {
+		validTo, err = time.Parse("2006-01-02", args[8])
+		if err != nil {
+			return shim.Error("Error 5 " + err.Error())
+		}
+		if validTo.Before(validFrom) {
+			return shim.Error("Valid to date cannot be before valid from date")
+		}
+	}
+
+	objectType := "Revenue Share Agreement"
+	agreementObj := &revenueShareAgreement{objectType, agreementID, bookingProduct, fulfillingProduct, eventType, stakeholder1Percentage, stakeholder2Percentage, fixedFee, validFrom, validTo}
+	agreementBytes, err := json.Marshal(agreementObj)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	agreementKey, err := stub.CreateCompositeKey("revShareAgreement", []string{bookingProduct, fulfillingProduct, eventType, agreementID})
+	if err != nil {
+		return shim.Error("Error 7 " + err.Error())
+	}
+	err = stub.PutState(agreementKey, agreementBytes)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	return shim.Success(agreementBytes)
+}
+
+//==========================================================================================
+//queryRevenueShareAgreements - Function to query the agreements, optionally by booking product
+//==========================================================================================
+func (t *SimpleChaincode) queryRevenueShareAgreements(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	keys := []string{}
+	if len(args) > 0 && args[0] != "" {
+		keys = append(keys, args[0])
+	}
+	agreementIterator, err := stub.GetStateByPartialCompositeKey("revShareAgreement", keys)
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	defer agreementIterator.Close()
+
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("[")
+	for agreementIterator.HasNext() {
+		response, err := agreementIterator.Next()
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Value)
+		isRecordWritten = true
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+//========================================================================================
+//getRevenueShareAgreement - Common Function to resolve the agreement in force on a date
+//========================================================================================
+func getRevenueShareAgreement(stub shim.ChaincodeStubInterface, bookingProduct string, fulfillingProduct string, eventType string, eventDate time.Time) (*revenueShareAgreement, error) {
+	agreementIterator, err := stub.GetStateByPartialCompositeKey("revShareAgreement", []string{bookingProduct, fulfillingProduct, eventType})
+	if err != nil {
+		return nil, err
+	}
+	defer agreementIterator.Close()
+
+	//If more than one agreement is in force, the most recent one applies
+	var agreementInForce *revenueShareAgreement
+	for agreementIterator.HasNext() {
+		response, err := agreementIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		agreementObj := &revenueShareAgreement{}
+		err = json.Unmarshal(response.Value, agreementObj)
+		if err != nil {
+			return nil, err
+		}
+		if eventDate.Before(agreementObj.ValidFrom) {
+			continue
+		}
+		if !agreementObj.ValidTo.IsZero() && !eventDate.Before(agreementObj.ValidTo.AddDate(0, 0, 1)) {
+			continue
+		}
+		if agreementInForce == nil || agreementObj.ValidFrom.After(agreementInForce.ValidFrom) {
+			agreementInForce = agreementObj
+		}
+	}
+	return agreementInForce, nil
+}
+
+//=======================================================================================
+//calculateRevenueShare - Common Function to split the revenue of a fulfilled segment
+//between the booking and fulfilling stakeholders as per the agreement in force
+//at the time of the event and convert the shares to their reporting currencies
+//=======================================================================================
+func calculateRevenueShare(stub shim.ChaincodeStubInterface, tripID string, bookedBy string, fulfilledBy string, eventType string, tripRevenue float64, revCurrency string, revenueEarnedCurrency string, eventDate time.Time) (revenueShare, float64, error) {
+	var stakeholder1Rev, stakeholder2Rev float64
+	agreementID := ""
+	//Calculate stakeholder revenue share only if booked by and fulfilled by parties are different
+	if bookedBy == fulfilledBy {
+		stakeholder1Rev = tripRevenue
+		stakeholder2Rev = tripRevenue
+	} else {
+		agreementObj, err := getRevenueShareAgreement(stub, bookedBy, fulfilledBy, eventType, eventDate)
+		if err != nil {
+			return revenueShare{}, 0, err
+		}
+		if agreementObj != nil {
+			agreementID = agreementObj.AgreementID
+			stakeholder1Rev = agreementObj.Stakeholder1Percentage/100*tripRevenue + agreementObj.FixedFee
+			stakeholder2Rev = agreementObj.Stakeholder2Percentage/100*tripRevenue - agreementObj.FixedFee
+		} else if eventType == "Offer Redeemed" {
+			//No agreement in force, fall back to the default split
+			agreementID = "default"
+			stakeholder1Rev = 0.2 * tripRevenue
+			stakeholder2Rev = 0.8 * tripRevenue
+		} else {
+			agreementID = "default"
+			stakeholder1Rev = 0.1 * tripRevenue
+			stakeholder2Rev = 0.9 * tripRevenue
+		}
+	}
+	return newRevenueShare(stub, tripID, bookedBy, fulfilledBy, tripRevenue, stakeholder1Rev, stakeholder2Rev, agreementID, revCurrency, revenueEarnedCurrency, eventDate)
+}
+
+//=======================================================================================
+//newRevenueShare - Common Function to record the shares of the booking and fulfilling
+//stakeholders of a revenue, converted to their reporting currencies
+//=======================================================================================
+func newRevenueShare(stub shim.ChaincodeStubInterface, tripID string, bookedBy string, fulfilledBy string, tripRevenue float64, stakeholder1Rev float64, stakeholder2Rev float64, agreementID string, revCurrency string, revenueEarnedCurrency string, eventDate time.Time) (revenueShare, float64, error) {
+	stakeholder1Rev = math.Round(stakeholder1Rev*100) / 100
+	stakeholder2Rev = math.Round(stakeholder2Rev*100) / 100
+	tripRevenue = math.Round(tripRevenue*100) / 100
+	//Convert the revenue shares to the reporting currency of each stakeholder using the rate at the time of the event
+	stakeholder1Currency, err := getReportingCurrency(stub, bookedBy, revCurrency)
+	if err != nil {
+		return revenueShare{}, 0, err
+	}
+	stakeholder1RevConverted, err := convertAmount(stub, stakeholder1Rev, revCurrency, stakeholder1Currency, eventDate)
+	if err != nil {
+		return revenueShare{}, 0, err
+	}
+	stakeholder2Currency, err := getReportingCurrency(stub, fulfilledBy, revCurrency)
+	if err != nil {
+		return revenueShare{}, 0, err
+	}
+	stakeholder2RevConverted, err := convertAmount(stub, stakeholder2Rev, revCurrency, stakeholder2Currency, eventDate)
+	if err != nil {
+		return revenueShare{}, 0, err
+	}
+	revenueEarnedRev, err := convertAmount(stub, stakeholder1Rev, revCurrency, revenueEarnedCurrency, eventDate)
+	if err != nil {
+		return revenueShare{}, 0, err
+	}
+	revShareObj := revenueShare{tripID, fulfilledBy, bookedBy, fulfilledBy, tripRevenue, revCurrency, stakeholder1Rev, stakeholder2Rev, agreementID, stakeholder1Currency, stakeholder1RevConverted, stakeholder2Currency, stakeholder2RevConverted, eventDate}
+	return revShareObj, revenueEarnedRev, nil
+}
+
 //===========================================================
 //queryTrip - Function to query Trip booking based on trip ID
 //===========================================================
@@ -405,8 +887,95 @@ func (t *SimpleChaincode) queryTrip(stub shim.ChaincodeStubInterface, args []str
 	if err != nil {
 		return shim.Error("Error 4 " + err.Error())
 	}
+	//Trip can also be queried by its ticket number
+	if tripBytes == nil {
+		_, tripBytes, err = getTrip(stub, tripID)
+		if err != nil {
+			return shim.Error("Error 5 " + err.Error())
+		}
+	}
+	return shim.Success(tripBytes)
+}
+
+//===========================================================================
+//queryTripByTicketNumber - Function to query Trip booking by ticket number
+//===========================================================================
+func (t *SimpleChaincode) queryTripByTicketNumber(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 || args[0] == "" {
+		return shim.Error("Ticket number cannot be null")
+	}
+	ticketKey, err := stub.CreateCompositeKey("ticketNumber", []string{args[0]})
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	tktIDBytes, err := stub.GetState(ticketKey)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if tktIDBytes == nil {
+		return shim.Error("Ticket number " + args[0] + " does not exist in the system")
+	}
+	tripBytes, err := stub.GetState(string(tktIDBytes))
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
 	return shim.Success(tripBytes)
 }
+
+//=====================================================================================
+//getTrip - Common Function to get a trip by trip ID or ticket number, returns the trip
+//ID along with the trip
+//=====================================================================================
+func getTrip(stub shim.ChaincodeStubInterface, tripID string) (string, []byte, error) {
+	tripBytes, err := stub.GetState(tripID)
+	if err != nil {
+		return "", nil, err
+	}
+	if tripBytes != nil {
+		return tripID, tripBytes, nil
+	}
+	ticketKey, err := stub.CreateCompositeKey("ticketNumber", []string{tripID})
+	if err != nil {
+		return "", nil, err
+	}
+	tktIDBytes, err := stub.GetState(ticketKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if tktIDBytes != nil {
+		tripBytes, err = stub.GetState(string(tktIDBytes))
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if tripBytes == nil {
+		return "", nil, fmt.Errorf("Trip ID %s does not exist in the system", tripID)
+	}
+	return string(tktIDBytes), tripBytes, nil
+}
+
+//=======================================================================================
+//getTicketNumber - Common Function to allocate the human-friendly ticket number from the
+//transaction ID. Only the candidate keys are read, so bookings do not conflict
+//=======================================================================================
+func getTicketNumber(stub shim.ChaincodeStubInterface, txID string) (string, error) {
+	var length int
+	for length = 8; length <= len(txID); length += 4 {
+		ticketNumber := "e-Ticket-" + strings.ToUpper(txID[:length])
+		ticketKey, err := stub.CreateCompositeKey("ticketNumber", []string{ticketNumber})
+		if err != nil {
+			return "", err
+		}
+		tktIDBytes, err := stub.GetState(ticketKey)
+		if err != nil {
+			return "", err
+		}
+		if tktIDBytes == nil {
+			return ticketNumber, nil
+		}
+	}
+	return "e-Ticket-" + strings.ToUpper(txID), nil
+}
 func (t *SimpleChaincode) queryTripHistory(stub shim.ChaincodeStubInterface, args []string) peer.Response {
 	tripID := args[0]
 	//Get the transaction history and write into a buffer
@@ -464,8 +1033,12 @@ func (t *SimpleChaincode) queryTripsByStakeholder(stub shim.ChaincodeStubInterfa
 	}
 	stakeholder := args[0]
 	//geo := args[1]
-	queryString := fmt.Sprintf("SELECT key as tktID, json_extract(valueJson,'$.creationDate') as creationDate, json_extract(valueJson,'$.progress') as progress, json_extract(valueJson, '$.status') as status, json_extract(valueJson, '$.bookedUsingProduct') as bookedUsingProduct, json_extract(valueJson,'$.products') as products, json_extract(valueJson, '$.fromLOC') as fromLOC, json_extract(valueJson,'$.toLOC') as toLOC, json_extract(valueJson,'$.revenueEarned')as revenueEarned,json_extract(valueJson,'$.revenuesharing') as revenuesharing  FROM <STATE> WHERE json_extract(valueJson, '$.objectType', '$.bookedUsingProduct') = '[\"Trips\",\"%s\"]'", stakeholder)
-	//	queryString := fmt.Sprintf("SELECT key as tktID,valueJson FROM <state> WHERE json_extract(valueJson, '$.objectType') = '\"Trips\"' AND json_extract(valueJson, '$.bookedUsingProduct') =" stakeholder)
+	query := newRichQuery("tktID", "creationDate", "progress", "status", "bookedUsingProduct", "products", "fromLOC", "toLOC", "revenueEarned", "revenuesharing")
+	query.where("objectType", "=", "Trips").where("bookedUsingProduct", "=", stakeholder)
+	queryString, err := buildQueryString(stub, query)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	TripsList, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -481,8 +1054,55 @@ func (t *SimpleChaincode) queryTripsByRider(stub shim.ChaincodeStubInterface, ar
 		return shim.Error("Rider ID cannot be null")
 	}
 	riderID := args[0]
-	queryString := fmt.Sprintf("SELECT valueJson FROM <STATE> WHERE json_extract(valueJson, '$.objectType', '$.riderID') = '[\"Trips\",\"%s\"]'", riderID)
+	query := newRichQuery()
+	query.where("objectType", "=", "Trips").where("riderID", "=", riderID)
+	queryString, err := buildQueryString(stub, query)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	TripsList, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(TripsList)
+}
 
+//==============================================================================
+//queryTripsByGeography - Function to query the trips to a region of the location
+//registry, optionally booked between from and to dates (YYYY-MM-DD)
+//==============================================================================
+func (t *SimpleChaincode) queryTripsByGeography(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 3")
+	}
+	if args[0] == "" {
+		return shim.Error("Region cannot be null")
+	}
+	region, err := getRegisteredRegion(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	query := newRichQuery()
+	query.where("objectType", "=", "Trips").where("geography", "=", region)
+	if args[1] != "" {
+		fromDate, err := time.Parse("2006-01-02", args[1])
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		query.where("creationDate", ">=", fromDate.Format("2006-01-02"))
+	}
+	if args[2] != "" {
+		toDate, err := time.Parse("2006-01-02", args[2])
+		if err != nil {
+			return shim.Error("Error 3 " + err.Error())
+		}
+		//To date is inclusive
+		query.where("creationDate", "<", toDate.AddDate(0, 0, 1).Format("2006-01-02"))
+	}
+	queryString, err := buildQueryString(stub, query)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
 	TripsList, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -531,18 +1151,189 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	return buffer.Bytes(), nil
 }
 
-//==========================================
-//getKPIData - Common Function for all KPIs
-//==========================================
-
-func (t *SimpleChaincode) getKPIData(stub shim.ChaincodeStubInterface, args []string) peer.Response {
-	stakeholder := args[0]
-	//geography := args[1]
-	if stakeholder == "" {
-		return shim.Error("Stakeholder cannot be null")
+//=====================================================================================
+//setQueryDialect - Function to set the rich query language of the state database,
+//sql for the json_extract SQL of the Oracle state database or couchdb for Mango selectors
+//=====================================================================================
+func (t *SimpleChaincode) setQueryDialect(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	//Only administrators can change the query dialect of the channel
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	dialect := strings.ToLower(args[0])
+	if dialect != "sql" && dialect != "couchdb" {
+		return shim.Error("Invalid query dialect " + args[0])
+	}
+	err = stub.PutState("QueryDialect", []byte(dialect))
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	return shim.Success([]byte("Query dialect set to " + dialect))
+}
+
+//=====================================================================================
+//newRichQuery - Function to start a rich query returning the given fields of the
+//matching documents, or the whole documents when no fields are given
+//=====================================================================================
+func newRichQuery(fields ...string) *richQuery {
+	return &richQuery{fields, []queryCondition{}}
+}
+
+//where adds a condition on a field, the operator is one of =, >, >=, < and <=
+func (q *richQuery) where(field string, operator string, value string) *richQuery {
+	q.Conditions = append(q.Conditions, queryCondition{field, operator, value})
+	return q
+}
+
+//=====================================================================================
+//buildQueryString - Common Function to build the query string of a rich query in the
+//dialect of the state database, the values are escaped and never part of the syntax
+//=====================================================================================
+func buildQueryString(stub shim.ChaincodeStubInterface, query *richQuery) (string, error) {
+	var i int
+	for i = 0; i < len(query.Fields); i++ {
+		if !isQueryField(query.Fields[i]) {
+			return "", fmt.Errorf("Invalid query field %s", query.Fields[i])
+		}
+	}
+	for i = 0; i < len(query.Conditions); i++ {
+		if !isQueryField(query.Conditions[i].Field) {
+			return "", fmt.Errorf("Invalid query field %s", query.Conditions[i].Field)
+		}
+		if getMangoOperator(query.Conditions[i].Operator) == "" {
+			return "", fmt.Errorf("Invalid query operator %s", query.Conditions[i].Operator)
+		}
+	}
+	dialectBytes, err := stub.GetState("QueryDialect")
+	if err != nil {
+		return "", err
+	}
+	if string(dialectBytes) == "couchdb" {
+		return buildCouchDBQuery(query)
+	}
+	return buildSQLQuery(query)
+}
+
+func buildSQLQuery(query *richQuery) (string, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("SELECT ")
+	if len(query.Fields) == 0 {
+		buffer.WriteString("valueJson")
+	}
+	var i int
+	for i = 0; i < len(query.Fields); i++ {
+		if i > 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString("json_extract(valueJson, '$." + query.Fields[i] + "') as " + query.Fields[i])
+	}
+	buffer.WriteString(" FROM <STATE>")
+	for i = 0; i < len(query.Conditions); i++ {
+		if i == 0 {
+			buffer.WriteString(" WHERE ")
+		} else {
+			buffer.WriteString(" AND ")
+		}
+		//json_extract of a single path returns the SQL value, the value is compared as an SQL
+		//string literal with its quotes escaped
+		value := strings.Replace(query.Conditions[i].Value, "'", "''", -1)
+		buffer.WriteString("json_extract(valueJson, '$." + query.Conditions[i].Field + "') " + query.Conditions[i].Operator + " '" + value + "'")
+	}
+	return buffer.String(), nil
+}
+
+func buildCouchDBQuery(query *richQuery) (string, error) {
+	selector := map[string]interface{}{}
+	var i int
+	for i = 0; i < len(query.Conditions); i++ {
+		fieldSelector, ok := selector[query.Conditions[i].Field].(map[string]interface{})
+		if !ok {
+			fieldSelector = map[string]interface{}{}
+			selector[query.Conditions[i].Field] = fieldSelector
+		}
+		fieldSelector[getMangoOperator(query.Conditions[i].Operator)] = query.Conditions[i].Value
+	}
+	queryObj := map[string]interface{}{"selector": selector}
+	if len(query.Fields) > 0 {
+		queryObj["fields"] = query.Fields
+	}
+	queryBytes, err := json.Marshal(queryObj)
+	if err != nil {
+		return "", err
+	}
+	return string(queryBytes), nil
+}
+
+func getMangoOperator(operator string) string {
+	if operator == "=" {
+		return "$eq"
+	} else if operator == ">" {
+		return "$gt"
+	} else if operator == ">=" {
+		return "$gte"
+	} else if operator == "<" {
+		return "$lt"
+	} else if operator == "<=" {
+		return "$lte"
+	}
+	return ""
+}
+
+//Field names become part of the query syntax and are restricted to plain identifiers
+func isQueryField(field string) bool {
+	if field == "" {
+		return false
+	}
+	var i int
+	for i = 0; i < len(field); i++ {
+		c := field[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+//=====================================================================================
+//getKPIData - Common Function for all KPIs
+//Arguments: stakeholder, geography (not used), reporting period (day, week, month) to
+//override the reporting period of the stakeholder KPI parameters
+//=====================================================================================
+
+func (t *SimpleChaincode) getKPIData(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	stakeholder := args[0]
+	//geography := args[1]
+	if stakeholder == "" {
+		return shim.Error("Stakeholder cannot be null")
+	}
+
+	//Revenue is aggregated in the reporting currency of the stakeholder
+	reportingCurrency, err := getReportingCurrency(stub, stakeholder, "")
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	parametersObj, err := getKPIParameters(stub, stakeholder)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	reportingPeriod := parametersObj.ReportingPeriod
+	if len(args) > 2 && args[2] != "" {
+		reportingPeriod = args[2]
+		if reportingPeriod != "day" && reportingPeriod != "week" && reportingPeriod != "month" {
+			return shim.Error("Invalid reporting period " + reportingPeriod)
+		}
 	}
 
-	queryString := fmt.Sprintf("SELECT json_extract(valueJson,'$.revenueEarned')as revenueEarned FROM <STATE> WHERE json_extract(valueJson, '$.objectType', '$.bookedUsingProduct') = '[\"Trips\",\"%s\"]'", stakeholder)
+	query := newRichQuery("revenueEarned", "revenueEarnedCurrency", "currency", "creationDate", "status")
+	query.where("objectType", "=", "Trips").where("bookedUsingProduct", "=", stakeholder)
+	queryString, err := buildQueryString(stub, query)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
 	resultsIterator, err := stub.GetQueryResult(queryString)
 	if err != nil {
 		return shim.Error("Error 0 " + err.Error())
@@ -551,58 +1342,2290 @@ func (t *SimpleChaincode) getKPIData(stub shim.ChaincodeStubInterface, args []st
 	tripCount := 0
 	var revenue, cost, tripRevenue float64
 	revenue = 0.00
-	//	var buffer bytes.Buffer
+	periods := map[string]*kpiPeriod{}
 	for resultsIterator.HasNext() {
 		response, err := resultsIterator.Next()
 		if err != nil {
 			return shim.Error("Error 1 " + err.Error())
 		}
 
-		respString := string(response.Value)
-		respJson := strings.Split(respString, ":")
-		tripRev := respJson[1]
-		tripRevJson := strings.Split(tripRev, "}")
-		tripRevStr := tripRevJson[0]
-		/*
-			if respString == "" || respString == "null" || response.Value == nil {
-				respString = "0"
-			}
-
-			buffer.Write(response.Value)
-			buffer.WriteString(",")
-		*/
-		//return shim.Error(tripRevStr)
-		tripRevenue, err = strconv.ParseFloat(tripRevStr, 64)
+		respObj := &tripDetails{}
+		err = json.Unmarshal(response.Value, respObj)
 		if err != nil {
-			tripRevenue = 0
-			//shim.Error("Error 1.5 " + err.Error())
+			respObj.RevenueEarned = 0
+		}
+		//Trips created before revenue was tracked per currency hold revenue in the trip currency
+		tripCurrency := respObj.RevenueEarnedCurrency
+		if tripCurrency == "" {
+			tripCurrency = respObj.Currency
+		}
+		if reportingCurrency == "" {
+			reportingCurrency = tripCurrency
+		}
+		tripRevenue, err = convertAmount(stub, respObj.RevenueEarned, tripCurrency, reportingCurrency, respObj.CreationDate)
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		period, periodStart := getKPIPeriod(respObj.CreationDate, reportingPeriod)
+		periodObj, ok := periods[period]
+		if !ok {
+			periodObj = &kpiPeriod{period, periodStart, 0, 0, 0}
+			periods[period] = periodObj
+		}
+		//Increment the trip count, cancelled trips only contribute the revenue retained after refund
+		if !isTripCancelled(respObj.Status) {
+			tripCount += 1
+			periodObj.NoOfTrips += 1
 		}
-
-		/*
-			respObj := &tripDetails{}
-			err = json.Unmarshal(respBytes, respObj)
-			if err != nil {
-				return shim.Error("Error 2 " + err.Error())
-			}
-		*/
-		//Increment the trip count
-		tripCount += 1
 		if tripRevenue >= 0 {
 			revenue = revenue + tripRevenue
+			periodObj.Revenue = periodObj.Revenue + tripRevenue
 		}
 
 	}
-	//Total number of organizations are hardcoded
-	numberOfOrgs := 3
-	//Determine cost relative to revenue (40% of revenue is cost)
-	cost = 0.97 * revenue
+	//Total number of organizations are the stakeholders registered on the ledger
+	numberOfOrgs, err := getStakeholderCount(stub)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	//Determine cost of each period from the cost ratio and the fixed cost lines of the stakeholder
+	//Periods are processed in chronological order so that the result is deterministic
+	periodKeys := []string{}
+	for period := range periods {
+		periodKeys = append(periodKeys, period)
+	}
+	sort.Strings(periodKeys)
+	kpiPeriods := []kpiPeriod{}
+	var j int
+	for j = 0; j < len(periodKeys); j++ {
+		periodObj := periods[periodKeys[j]]
+		periodCost := parametersObj.CostRatio * periodObj.Revenue
+		var i int
+		for i = 0; i < len(parametersObj.FixedCosts); i++ {
+			fixedCost, err := convertAmount(stub, parametersObj.FixedCosts[i].Amount, parametersObj.FixedCosts[i].Currency, reportingCurrency, periodObj.PeriodStart)
+			if err != nil {
+				return shim.Error("Error 7 " + err.Error())
+			}
+			periodCost = periodCost + fixedCost
+		}
+		cost = cost + periodCost
+		kpiPeriods = append(kpiPeriods, kpiPeriod{periodObj.Period, periodObj.PeriodStart, math.Round(periodObj.Revenue), math.Round(periodCost), periodObj.NoOfTrips})
+	}
 
 	//Create a KPI object
-	kpiObj := &KPI{numberOfOrgs, math.Round(revenue), math.Round(cost), tripCount}
+	kpiObj := &KPI{numberOfOrgs, math.Round(revenue), math.Round(cost), tripCount, reportingCurrency, reportingPeriod, kpiPeriods}
 	kpiBytes, err := json.Marshal(kpiObj)
 	if err != nil {
 		return shim.Error("Error 3 " + err.Error())
 	}
-	//return shim.Success(buffer.Bytes())
 	return shim.Success(kpiBytes)
 }
+
+//==================================================================================
+//getKPIPeriod - Common Function to get the reporting period bucket of a date
+//==================================================================================
+func getKPIPeriod(date time.Time, reportingPeriod string) (string, time.Time) {
+	date = date.UTC()
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	if reportingPeriod == "day" {
+		return day.Format("2006-01-02"), day
+	} else if reportingPeriod == "week" {
+		//Weeks start on Monday as per ISO 8601
+		year, week := date.ISOWeek()
+		weekday := int(day.Weekday()+6) % 7
+		return fmt.Sprintf("%d-W%02d", year, week), day.AddDate(0, 0, -weekday)
+	}
+	month := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return month.Format("2006-01"), month
+}
+
+//=========================================================================================
+//setKPIParameters - Function to set the KPI cost model and reporting period of a stakeholder
+//Arguments: stakeholder, cost ratio (fraction of revenue), fixed cost lines per period
+//(description:amount:currency, comma separated), reporting period (day, week, month)
+//=========================================================================================
+func (t *SimpleChaincode) setKPIParameters(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments, expecting 4")
+	}
+	//Only administrators can change the KPI cost model
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	stakeholderID := args[0]
+	if stakeholderID == "" {
+		return shim.Error("Stakeholder cannot be null")
+	}
+	costRatio := 0.0
+	if args[1] != "" {
+		costRatio, err = strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		if costRatio < 0 {
+			return shim.Error("Cost ratio cannot be negative")
+		}
+	}
+	fixedCosts := []kpiCostLine{}
+	if args[2] != "" {
+		costList := strings.Split(args[2], ",")
+		var i int
+		for i = 0; i < len(costList); i++ {
+			costValues := strings.Split(strings.TrimSpace(costList[i]), ":")
+			if len(costValues) != 3 {
+				return shim.Error("Invalid fixed cost line " + costList[i])
+			}
+			amount, err := strconv.ParseFloat(costValues[1], 64)
+			if err != nil {
+				return shim.Error("Error 3 " + err.Error())
+			}
+			fixedCosts = append(fixedCosts, kpiCostLine{costValues[0], amount, strings.ToUpper(costValues[2])})
+		}
+	}
+	reportingPeriod := args[3]
+	if reportingPeriod == "" {
+		reportingPeriod = "month"
+	}
+	if reportingPeriod != "day" && reportingPeriod != "week" && reportingPeriod != "month" {
+		return shim.Error("Invalid reporting period " + reportingPeriod)
+	}
+
+	objectType := "KPI Parameters"
+	parametersObj := &kpiParameters{objectType, stakeholderID, costRatio, fixedCosts, reportingPeriod}
+	parametersBytes, err := json.Marshal(parametersObj)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	parametersKey, err := stub.CreateCompositeKey("kpiParameters", []string{stakeholderID})
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	err = stub.PutState(parametersKey, parametersBytes)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	return shim.Success(parametersBytes)
+}
+
+//===========================================================================
+//queryKPIParameters - Function to query the KPI parameters of a stakeholder
+//===========================================================================
+func (t *SimpleChaincode) queryKPIParameters(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	parametersObj, err := getKPIParameters(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	parametersBytes, err := json.Marshal(parametersObj)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	return shim.Success(parametersBytes)
+}
+
+//====================================================================================
+//getKPIParameters - Common Function to get the KPI parameters of a stakeholder,
+//stakeholders without parameters report revenue without cost per month
+//====================================================================================
+func getKPIParameters(stub shim.ChaincodeStubInterface, stakeholderID string) (*kpiParameters, error) {
+	parametersKey, err := stub.CreateCompositeKey("kpiParameters", []string{stakeholderID})
+	if err != nil {
+		return nil, err
+	}
+	parametersBytes, err := stub.GetState(parametersKey)
+	if err != nil {
+		return nil, err
+	}
+	if parametersBytes == nil {
+		return &kpiParameters{"KPI Parameters", stakeholderID, 0, []kpiCostLine{}, "month"}, nil
+	}
+	parametersObj := &kpiParameters{}
+	err = json.Unmarshal(parametersBytes, parametersObj)
+	if err != nil {
+		return nil, err
+	}
+	return parametersObj, nil
+}
+
+//=====================================================================================
+//registerStakeholder - Function to register an organization taking part in the trips
+//Arguments: stakeholder ID, name
+//=====================================================================================
+func (t *SimpleChaincode) registerStakeholder(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	//Only administrators can register stakeholders
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	stakeholderID := args[0]
+	if stakeholderID == "" {
+		return shim.Error("Stakeholder ID cannot be null")
+	}
+	stakeholderKey, err := stub.CreateCompositeKey("stakeholder", []string{stakeholderID})
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	stakeholderBytes, err := stub.GetState(stakeholderKey)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	if stakeholderBytes != nil {
+		return shim.Error("Stakeholder " + stakeholderID + " is already registered")
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	objectType := "Stakeholder"
+	stakeholderObj := &stakeholder{objectType, stakeholderID, args[1], time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()}
+	stakeholderBytes, err = json.Marshal(stakeholderObj)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	err = stub.PutState(stakeholderKey, stakeholderBytes)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	return shim.Success(stakeholderBytes)
+}
+
+//==============================================================
+//queryStakeholders - Function to query the registered stakeholders
+//==============================================================
+func (t *SimpleChaincode) queryStakeholders(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	stakeholderIterator, err := stub.GetStateByPartialCompositeKey("stakeholder", []string{})
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	defer stakeholderIterator.Close()
+
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("[")
+	for stakeholderIterator.HasNext() {
+		response, err := stakeholderIterator.Next()
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Value)
+		isRecordWritten = true
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+func getStakeholderCount(stub shim.ChaincodeStubInterface) (int, error) {
+	stakeholderIterator, err := stub.GetStateByPartialCompositeKey("stakeholder", []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer stakeholderIterator.Close()
+	count := 0
+	for stakeholderIterator.HasNext() {
+		_, err := stakeholderIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		count = count + 1
+	}
+	return count, nil
+}
+
+//==============================================================================
+//setFxRate - Function to set the exchange rate of base to quote currency
+//effective from the given date (1 base = rate quote)
+//==============================================================================
+func (t *SimpleChaincode) setFxRate(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments, expecting 4")
+	}
+	//Only administrators can publish exchange rates
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	base := strings.ToUpper(args[0])
+	quote := strings.ToUpper(args[1])
+	if base == "" || quote == "" || base == quote {
+		return shim.Error("Base and quote currencies must be different and cannot be null")
+	}
+	rate, err := strconv.ParseFloat(args[2], 64)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if rate <= 0 {
+		return shim.Error("Exchange rate must be greater than zero")
+	}
+	effectiveDate, err := time.Parse("2006-01-02", args[3])
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+
+	objectType := "FX Rate"
+	rateObj := &fxRate{objectType, base, quote, rate, effectiveDate}
+	rateBytes, err := json.Marshal(rateObj)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	rateKey, err := stub.CreateCompositeKey("fxRate", []string{base, quote, args[3]})
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	err = stub.PutState(rateKey, rateBytes)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	return shim.Success(rateBytes)
+}
+
+//=====================================================================
+//queryFxRate - Function to query the exchange rate in effect on a date
+//=====================================================================
+func (t *SimpleChaincode) queryFxRate(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 3")
+	}
+	rateDate, err := time.Parse("2006-01-02", args[2])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	rate, err := getFxRate(stub, strings.ToUpper(args[0]), strings.ToUpper(args[1]), rateDate.AddDate(0, 0, 1).Add(-time.Nanosecond))
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	return shim.Success([]byte(strconv.FormatFloat(rate, 'f', -1, 64)))
+}
+
+//==================================================================================
+//setReportingCurrency - Function to set the currency a stakeholder reports revenue in
+//==================================================================================
+func (t *SimpleChaincode) setReportingCurrency(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	//Only administrators can change the reporting currency of a stakeholder
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	stakeholder := args[0]
+	currency := strings.ToUpper(args[1])
+	if stakeholder == "" || currency == "" {
+		return shim.Error("Stakeholder and currency cannot be null")
+	}
+	currencyKey, err := stub.CreateCompositeKey("reportingCurrency", []string{stakeholder})
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	err = stub.PutState(currencyKey, []byte(currency))
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	return shim.Success([]byte("Reporting currency of " + stakeholder + " set to " + currency))
+}
+
+//========================================================================================
+//getReportingCurrency - Common Function to get the reporting currency of a stakeholder,
+//returns the default currency if none has been set
+//========================================================================================
+func getReportingCurrency(stub shim.ChaincodeStubInterface, stakeholder string, defaultCurrency string) (string, error) {
+	currencyKey, err := stub.CreateCompositeKey("reportingCurrency", []string{stakeholder})
+	if err != nil {
+		return "", err
+	}
+	currencyBytes, err := stub.GetState(currencyKey)
+	if err != nil {
+		return "", err
+	}
+	if currencyBytes == nil {
+		return defaultCurrency, nil
+	}
+	return string(currencyBytes), nil
+}
+
+//=========================================================================================
+//getFxRate - Common Function to get the exchange rate in effect at the given time, using
+//the inverse rate if only the opposite currency pair has been set
+//=========================================================================================
+func getFxRate(stub shim.ChaincodeStubInterface, base string, quote string, rateDate time.Time) (float64, error) {
+	if base == quote {
+		return 1, nil
+	}
+	rate, found, err := getLatestFxRate(stub, base, quote, rateDate)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return rate, nil
+	}
+	rate, found, err = getLatestFxRate(stub, quote, base, rateDate)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return 1 / rate, nil
+	}
+	return 0, fmt.Errorf("No exchange rate from %s to %s in effect on %s", base, quote, rateDate.Format("2006-01-02"))
+}
+
+func getLatestFxRate(stub shim.ChaincodeStubInterface, base string, quote string, rateDate time.Time) (float64, bool, error) {
+	rateIterator, err := stub.GetStateByPartialCompositeKey("fxRate", []string{base, quote})
+	if err != nil {
+		return 0, false, err
+	}
+	defer rateIterator.Close()
+
+	//Keys are ordered by effective date, the last one not after the rate date applies
+	var rate float64
+	found := false
+	for rateIterator.HasNext() {
+		response, err := rateIterator.Next()
+		if err != nil {
+			return 0, false, err
+		}
+		rateObj := &fxRate{}
+		err = json.Unmarshal(response.Value, rateObj)
+		if err != nil {
+			return 0, false, err
+		}
+		if rateObj.EffectiveDate.After(rateDate) {
+			break
+		}
+		rate = rateObj.Rate
+		found = true
+	}
+	return rate, found, nil
+}
+
+//============================================================================
+//convertAmount - Common Function to convert an amount between two currencies
+//============================================================================
+func convertAmount(stub shim.ChaincodeStubInterface, amount float64, from string, to string, rateDate time.Time) (float64, error) {
+	if amount == 0 || from == "" || to == "" || strings.EqualFold(from, to) {
+		return amount, nil
+	}
+	rate, err := getFxRate(stub, strings.ToUpper(from), strings.ToUpper(to), rateDate)
+	if err != nil {
+		return 0, err
+	}
+	return math.Round(amount*rate*100) / 100, nil
+}
+
+//=======================================================================================
+//generateSettlement - Function to net the revenue shares between each pair of
+//stakeholders for the period into a draft settlement statement, a draft can be
+//regenerated until the first counterparty acknowledges it
+//=======================================================================================
+func (t *SimpleChaincode) generateSettlement(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	periodStart, err := time.Parse("2006-01-02", args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	periodEnd, err := time.Parse("2006-01-02", args[1])
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if periodEnd.Before(periodStart) {
+		return shim.Error("Period end cannot be before period start")
+	}
+	//A settlement can be regenerated only while it is in draft
+	settlementID := "STL-" + args[0] + "-" + args[1]
+	existingBytes, err := stub.GetState(settlementID)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	if existingBytes != nil {
+		existingObj := &settlement{}
+		err = json.Unmarshal(existingBytes, existingObj)
+		if err != nil {
+			return shim.Error("Error 4 " + err.Error())
+		}
+		if existingObj.Status != "draft" {
+			return shim.Error("Settlement " + settlementID + " is already " + existingObj.Status)
+		}
+		//Acknowledgments are given for the statement as generated
+		if len(existingObj.Acknowledgments) > 0 {
+			return shim.Error("Settlement " + settlementID + " has been acknowledged and cannot be regenerated")
+		}
+	}
+
+	//Aggregate the amount the booking stakeholder owes the fulfilling stakeholder. Trips are
+	//read with a range query, unlike rich queries it is checked for phantom reads on commit so
+	//trips changed concurrently cannot be left out of the statement
+	resultsIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	defer resultsIterator.Close()
+	periodEndExclusive := periodEnd.AddDate(0, 0, 1)
+	payables := map[string]*settlementLine{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error("Error 6 " + err.Error())
+		}
+		//The range also returns the settlements and configuration records
+		tripObj := &tripDetails{}
+		err = json.Unmarshal(response.Value, tripObj)
+		if err != nil || tripObj.ObjectType != "Trips" {
+			continue
+		}
+		var i int
+		for i = 0; i < len(tripObj.RevenueSharing); i++ {
+			share := tripObj.RevenueSharing[i]
+			if share.Stakeholder1 == share.Stakeholder2 || share.FxRateDate.Before(periodStart) || !share.FxRateDate.Before(periodEndExclusive) {
+				continue
+			}
+			lineKey := share.Stakeholder1 + "~" + share.Stakeholder2 + "~" + share.RevenueCurrency
+			line, ok := payables[lineKey]
+			if !ok {
+				line = &settlementLine{share.Stakeholder1, share.Stakeholder2, share.RevenueCurrency, 0, 0, 0, 0}
+				payables[lineKey] = line
+			}
+			line.GrossPayable = line.GrossPayable + share.Stakeholder2Rev
+			line.NoOfShares = line.NoOfShares + 1
+		}
+	}
+
+	//Net the amounts owed in both directions into a single payable per pair and currency
+	lines := []settlementLine{}
+	for lineKey, line := range payables {
+		reverseKey := line.Payee + "~" + line.Payer + "~" + line.Currency
+		reverseLine, ok := payables[reverseKey]
+		if ok && reverseKey < lineKey {
+			continue
+		}
+		netLine := settlementLine{line.Payer, line.Payee, line.Currency, line.GrossPayable, 0, 0, line.NoOfShares}
+		if ok {
+			netLine.GrossOffset = reverseLine.GrossPayable
+			netLine.NoOfShares = netLine.NoOfShares + reverseLine.NoOfShares
+		}
+		netLine.NetAmount = math.Round((netLine.GrossPayable-netLine.GrossOffset)*100) / 100
+		if netLine.NetAmount < 0 {
+			netLine = settlementLine{netLine.Payee, netLine.Payer, netLine.Currency, netLine.GrossOffset, netLine.GrossPayable, -netLine.NetAmount, netLine.NoOfShares}
+		}
+		netLine.GrossPayable = math.Round(netLine.GrossPayable*100) / 100
+		netLine.GrossOffset = math.Round(netLine.GrossOffset*100) / 100
+		lines = append(lines, netLine)
+	}
+	//Order the lines so that every peer produces the same statement
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Payer != lines[j].Payer {
+			return lines[i].Payer < lines[j].Payer
+		}
+		if lines[i].Payee != lines[j].Payee {
+			return lines[i].Payee < lines[j].Payee
+		}
+		return lines[i].Currency < lines[j].Currency
+	})
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Error 7 " + err.Error())
+	}
+	generatedDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+	objectType := "Settlement"
+	settlementObj := &settlement{objectType, settlementID, periodStart, periodEnd, "draft", lines, []settlementAck{}, generatedDate, time.Time{}}
+	settlementBytes, err := json.Marshal(settlementObj)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	err = stub.PutState(settlementID, settlementBytes)
+	if err != nil {
+		return shim.Error("Error 9 " + err.Error())
+	}
+	err = stub.SetEvent("Settlement Generated", settlementBytes)
+	if err != nil {
+		return shim.Error("Error 10 " + err.Error())
+	}
+	return shim.Success(settlementBytes)
+}
+
+//=========================================================================================
+//acknowledgeSettlement - Function for a counterparty to acknowledge a settlement statement.
+//The statement is agreed once every counterparty has acknowledged it
+//=========================================================================================
+func (t *SimpleChaincode) acknowledgeSettlement(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	settlementObj, err := getSettlement(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	if settlementObj.Status != "draft" {
+		return shim.Error("Settlement " + settlementObj.SettlementID + " is already " + settlementObj.Status)
+	}
+	stakeholder, acknowledgedBy, err := getInvokingStakeholder(stub)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	counterparties := getSettlementCounterparties(settlementObj)
+	if !counterparties[stakeholder] {
+		return shim.Error(stakeholder + " is not a counterparty of settlement " + settlementObj.SettlementID)
+	}
+	var i int
+	for i = 0; i < len(settlementObj.Acknowledgments); i++ {
+		if settlementObj.Acknowledgments[i].Stakeholder == stakeholder {
+			return shim.Error("Settlement has already been acknowledged by " + stakeholder)
+		}
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	acknowledgeDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+	settlementObj.Acknowledgments = append(settlementObj.Acknowledgments, settlementAck{stakeholder, acknowledgedBy, acknowledgeDate})
+	event := "Settlement Acknowledged"
+	if len(settlementObj.Acknowledgments) == len(counterparties) {
+		settlementObj.Status = "agreed"
+		event = "Settlement Agreed"
+	}
+	return putSettlement(stub, settlementObj, event)
+}
+
+//===================================================================
+//markSettlementPaid - Function to mark an agreed settlement as paid
+//===================================================================
+func (t *SimpleChaincode) markSettlementPaid(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	settlementObj, err := getSettlement(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	if settlementObj.Status != "agreed" {
+		return shim.Error("Only an agreed settlement can be marked as paid, settlement " + settlementObj.SettlementID + " is " + settlementObj.Status)
+	}
+	stakeholder, _, err := getInvokingStakeholder(stub)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if !getSettlementCounterparties(settlementObj)[stakeholder] {
+		return shim.Error(stakeholder + " is not a counterparty of settlement " + settlementObj.SettlementID)
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	settlementObj.PaidDate = time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+	settlementObj.Status = "paid"
+	return putSettlement(stub, settlementObj, "Settlement Paid")
+}
+
+//=================================================
+//querySettlement - Function to query a settlement
+//=================================================
+func (t *SimpleChaincode) querySettlement(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 || args[0] == "" {
+		return shim.Error("Settlement ID cannot be null")
+	}
+	settlementBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	if settlementBytes == nil {
+		return shim.Error("Settlement " + args[0] + " does not exist in the system")
+	}
+	return shim.Success(settlementBytes)
+}
+
+func getSettlement(stub shim.ChaincodeStubInterface, settlementID string) (*settlement, error) {
+	settlementBytes, err := stub.GetState(settlementID)
+	if err != nil {
+		return nil, err
+	}
+	if settlementBytes == nil {
+		return nil, fmt.Errorf("Settlement %s does not exist in the system", settlementID)
+	}
+	settlementObj := &settlement{}
+	err = json.Unmarshal(settlementBytes, settlementObj)
+	if err != nil {
+		return nil, err
+	}
+	return settlementObj, nil
+}
+
+func putSettlement(stub shim.ChaincodeStubInterface, settlementObj *settlement, event string) peer.Response {
+	settlementBytes, err := json.Marshal(settlementObj)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	err = stub.PutState(settlementObj.SettlementID, settlementBytes)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	err = stub.SetEvent(event, settlementBytes)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	return shim.Success(settlementBytes)
+}
+
+func getSettlementCounterparties(settlementObj *settlement) map[string]bool {
+	counterparties := map[string]bool{}
+	var i int
+	for i = 0; i < len(settlementObj.Lines); i++ {
+		counterparties[settlementObj.Lines[i].Payer] = true
+		counterparties[settlementObj.Lines[i].Payee] = true
+	}
+	return counterparties
+}
+
+//===================================================================================
+//checkRedemptionInvoker - Common Function to check that the invoker is the rider of the
+//trip (riderID attribute), or acts for the booking operator or the operator of the offer
+//===================================================================================
+func checkRedemptionInvoker(stub shim.ChaincodeStubInterface, tripObj *tripDetails, offerObj *offer) error {
+	riderID, found, err := cid.GetAttributeValue(stub, "riderID")
+	if err != nil {
+		return err
+	}
+	if found && riderID == tripObj.RiderID {
+		return nil
+	}
+	stakeholder, _, err := getInvokingStakeholder(stub)
+	if err != nil {
+		return fmt.Errorf("Invoker is neither the rider of the trip nor an operator: %s", err.Error())
+	}
+	if stakeholder != tripObj.BookedUsingProduct && stakeholder != offerObj.Operator {
+		return fmt.Errorf("Stakeholder %s is not authorized to redeem offers for rider %s", stakeholder, tripObj.RiderID)
+	}
+	return nil
+}
+
+//===================================================================================
+//getInvokingStakeholder - Common Function to get the stakeholder the invoker acts for,
+//taken from the stakeholder attribute of the invoker certificate
+//===================================================================================
+func getInvokingStakeholder(stub shim.ChaincodeStubInterface) (string, string, error) {
+	stakeholder, found, err := cid.GetAttributeValue(stub, "stakeholder")
+	if err != nil {
+		return "", "", err
+	}
+	if !found || stakeholder == "" {
+		return "", "", fmt.Errorf("Invoker certificate does not carry a stakeholder attribute")
+	}
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", "", err
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", "", err
+	}
+	return stakeholder, mspID + "::" + id, nil
+}
+
+//===========================================================================================
+//setRefundPolicy - Function to configure the refund policy for trip cancellation
+//Arguments: tiers as minHoursBeforeDeparture:refundPercentage (comma separated, e.g.
+//"72:100,24:50,0:25"), refund percentage deducted per segment already used
+//===========================================================================================
+func (t *SimpleChaincode) setRefundPolicy(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	//Only administrators can change the refund policy
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	tiers := []refundTier{}
+	tierList := strings.Split(args[0], ",")
+	var i int
+	for i = 0; i < len(tierList); i++ {
+		tierValues := strings.Split(strings.TrimSpace(tierList[i]), ":")
+		if len(tierValues) != 2 {
+			return shim.Error("Invalid refund tier " + tierList[i])
+		}
+		minHours, err := strconv.ParseFloat(tierValues[0], 64)
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		refundPercentage, err := strconv.ParseFloat(tierValues[1], 64)
+		if err != nil {
+			return shim.Error("Error 3 " + err.Error())
+		}
+		if refundPercentage < 0 || refundPercentage > 100 {
+			return shim.Error("Refund percentage must be between 0 and 100")
+		}
+		tiers = append(tiers, refundTier{minHours, refundPercentage})
+	}
+	//Tiers are evaluated from the earliest cancellation onwards
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].MinHoursBeforeDeparture > tiers[j].MinHoursBeforeDeparture
+	})
+	usedSegmentDeductionPerc, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		usedSegmentDeductionPerc = 0
+	}
+
+	objectType := "Refund Policy"
+	policyObj := &refundPolicy{objectType, tiers, usedSegmentDeductionPerc}
+	policyBytes, err := json.Marshal(policyObj)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	err = stub.PutState("RefundPolicy", policyBytes)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	return shim.Success(policyBytes)
+}
+
+//===================================================================================================
+//cancelTrip - Function to cancel a trip, refund the rider as per the refund policy and reverse the
+//revenue shares of the stakeholders in proportion to the refund
+//===================================================================================================
+func (t *SimpleChaincode) cancelTrip(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 3")
+	}
+	reason := args[1]
+	if reason == "" {
+		return shim.Error("Cancellation reason cannot be null")
+	}
+	tktID, tripBytes, err := getTrip(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	tripObj := &tripDetails{}
+	err = json.Unmarshal(tripBytes, tripObj)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if isTripCancelled(tripObj.Status) {
+		return shim.Error("Trip ID " + tktID + " has already been cancelled")
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	cancellationDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	//Determine the maximum refund as per the refund policy
+	usedSegments, err := getUsedSegmentCount(stub, tktID)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	refundPercentage, err := getRefundPercentage(stub, tripObj.DepartureTime, cancellationDate, usedSegments)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	maxRefund := math.Round(tripObj.Price*refundPercentage) / 100
+	refundAmount := maxRefund
+	if args[2] != "" {
+		refundAmount, err = strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return shim.Error("Error 6 " + err.Error())
+		}
+		if refundAmount < 0 || refundAmount > maxRefund {
+			return shim.Error("Refund amount must be between 0 and " + strconv.FormatFloat(maxRefund, 'f', 2, 64) + " as per the refund policy")
+		}
+	}
+
+	//Write compensating revenue share entries in proportion to the refund
+	revShare := tripObj.RevenueSharing
+	revenueEarned := tripObj.RevenueEarned
+	if tripObj.Price > 0 && refundAmount > 0 {
+		refundRatio := refundAmount / tripObj.Price
+		var i int
+		for i = 0; i < len(tripObj.RevenueSharing); i++ {
+			share := tripObj.RevenueSharing[i]
+			reversalObj := revenueShare{share.TripID, share.FulfilledBy, share.Stakeholder1, share.Stakeholder2, -reverseAmount(share.TripRevenue, refundRatio), share.RevenueCurrency, -reverseAmount(share.Stakeholder1Rev, refundRatio), -reverseAmount(share.Stakeholder2Rev, refundRatio), share.AgreementID, share.Stakeholder1Currency, -reverseAmount(share.Stakeholder1RevConverted, refundRatio), share.Stakeholder2Currency, -reverseAmount(share.Stakeholder2RevConverted, refundRatio), cancellationDate}
+			revShare = append(revShare, reversalObj)
+		}
+		revenueEarned = revenueEarned - reverseAmount(revenueEarned, refundRatio)
+	}
+
+	tripObj.RevenueSharing = revShare
+	tripObj.RevenueEarned = revenueEarned
+	err = transitionTrip(stub, tripObj, "Cancelled", "Trip Cancelled")
+	if err != nil {
+		return shim.Error("Error 12 " + err.Error())
+	}
+	tripObj.Event = "Trip Cancelled"
+	tripObj.CancellationReason = reason
+	tripObj.RefundAmount = refundAmount
+	tripObj.CancellationDate = cancellationDate
+	tripNewBytes, err := json.Marshal(tripObj)
+	if err != nil {
+		return shim.Error("Error 7 " + err.Error())
+	}
+	err = stub.PutState(tktID, tripNewBytes)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	//Segments not yet travelled will not be fulfilled
+	segments, err := getTripSegments(stub, tktID)
+	if err != nil {
+		return shim.Error("Error 10 " + err.Error())
+	}
+	var i int
+	for i = 0; i < len(segments); i++ {
+		if segments[i].Status != "Scheduled" {
+			continue
+		}
+		segments[i].Status = "Cancelled"
+		segments[i].Event = "Segment Cancelled"
+		err = putTripSegment(stub, &segments[i])
+		if err != nil {
+			return shim.Error("Error 11 " + err.Error())
+		}
+	}
+	err = stub.SetEvent(tripObj.Event, tripNewBytes)
+	if err != nil {
+		return shim.Error("Error 9 " + err.Error())
+	}
+	return shim.Success(tripNewBytes)
+}
+
+func reverseAmount(amount float64, ratio float64) float64 {
+	return math.Round(amount*ratio*100) / 100
+}
+
+//=====================================================================================
+//getRefundPercentage - Common Function to get the refund percentage as per the refund
+//policy for the time before departure and the number of segments already used
+//=====================================================================================
+func getRefundPercentage(stub shim.ChaincodeStubInterface, departureTime time.Time, cancellationDate time.Time, usedSegments int) (float64, error) {
+	policyBytes, err := stub.GetState("RefundPolicy")
+	if err != nil {
+		return 0, err
+	}
+	//Without a refund policy the full fare of the unused trip is refundable
+	if policyBytes == nil {
+		if usedSegments > 0 {
+			return 0, nil
+		}
+		return 100, nil
+	}
+	policyObj := &refundPolicy{}
+	err = json.Unmarshal(policyBytes, policyObj)
+	if err != nil {
+		return 0, err
+	}
+	//Trips booked without departure time are treated as cancelled at departure
+	hoursBeforeDeparture := 0.0
+	if !departureTime.IsZero() {
+		hoursBeforeDeparture = departureTime.Sub(cancellationDate).Hours()
+	}
+	refundPercentage := 0.0
+	var i int
+	for i = 0; i < len(policyObj.Tiers); i++ {
+		if hoursBeforeDeparture >= policyObj.Tiers[i].MinHoursBeforeDeparture {
+			refundPercentage = policyObj.Tiers[i].RefundPercentage
+			break
+		}
+	}
+	refundPercentage = refundPercentage - float64(usedSegments)*policyObj.UsedSegmentDeductionPerc
+	if refundPercentage < 0 {
+		refundPercentage = 0
+	}
+	return refundPercentage, nil
+}
+
+//========================================================================
+//getUsedSegmentCount - Common Function to count the segments completed
+//========================================================================
+func getUsedSegmentCount(stub shim.ChaincodeStubInterface, tktID string) (int, error) {
+	segments, err := getTripSegments(stub, tktID)
+	if err != nil {
+		return 0, err
+	}
+	//A segment that has departed is considered used
+	if len(segments) > 0 {
+		usedSegments := 0
+		var i int
+		for i = 0; i < len(segments); i++ {
+			if segments[i].Status == "Completed" || segments[i].Status == "In Transit" {
+				usedSegments = usedSegments + 1
+			}
+		}
+		return usedSegments, nil
+	}
+	//Trips recorded before segment records were introduced are counted from the trip history
+	tripIterator, err := stub.GetHistoryForKey(tktID)
+	if err != nil {
+		return 0, err
+	}
+	defer tripIterator.Close()
+	usedSegments := 0
+	for tripIterator.HasNext() {
+		tripResponse, err := tripIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		tripRespObj := &tripDetails{}
+		err = json.Unmarshal(tripResponse.Value, tripRespObj)
+		if err != nil {
+			return 0, err
+		}
+		if tripRespObj.Event == "Segment Completed" {
+			usedSegments = usedSegments + 1
+		}
+	}
+	return usedSegments, nil
+}
+
+//=========================================================================================
+//addSegment - Function to add a segment fulfilled by an operator to a trip
+//Arguments: trip ID or ticket number, segment ID, operator, mode, from location, to location,
+//scheduled departure, scheduled arrival, price, currency
+//=========================================================================================
+func (t *SimpleChaincode) addSegment(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 10 {
+		return shim.Error("Incorrect number of arguments, expecting 10")
+	}
+	operator := args[2]
+	mode := args[3]
+	fromLOC := args[4]
+	toLOC := args[5]
+	if operator == "" || fromLOC == "" || toLOC == "" {
+		return shim.Error("Operator, from location and to location cannot be null")
+	}
+	_, err := getTripGeography(stub, fromLOC, toLOC)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	tktID, tripBytes, err := getTrip(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	tripObj := &tripDetails{}
+	err = json.Unmarshal(tripBytes, tripObj)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if isTripCancelled(tripObj.Status) {
+		return shim.Error("Trip ID " + tktID + " has been cancelled")
+	}
+	scheduledDeparture, err := time.Parse(time.RFC3339, args[6])
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	var scheduledArrival time.Time
+	if args[7] != "" {
+		scheduledArrival, err = time.Parse(time.RFC3339, args[7])
+		if err != nil {
+			return shim.Error("Error 4 " + err.Error())
+		}
+		if scheduledArrival.Before(scheduledDeparture) {
+			return shim.Error("Scheduled arrival cannot be before scheduled departure")
+		}
+	}
+	price, err := strconv.ParseFloat(args[8], 64)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	if price < 0 {
+		return shim.Error("Segment price cannot be negative")
+	}
+	currency := args[9]
+	if currency == "" {
+		currency = tripObj.Currency
+	}
+	segments, err := getTripSegments(stub, tktID)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	seqNo := len(segments) + 1
+	segmentID := args[1]
+	if segmentID == "" {
+		segmentID = "SEG" + strconv.Itoa(seqNo)
+	}
+	var i int
+	for i = 0; i < len(segments); i++ {
+		if segments[i].SegmentID == segmentID {
+			return shim.Error("Segment ID " + segmentID + " already exists for trip ID " + tktID)
+		}
+	}
+
+	objectType := "Trip Segment"
+	segmentObj := &tripSegment{objectType, tktID, segmentID, seqNo, operator, mode, fromLOC, toLOC, scheduledDeparture, scheduledArrival, time.Time{}, time.Time{}, price, currency, "Scheduled", "Segment Added", time.Time{}}
+	err = putTripSegment(stub, segmentObj)
+	if err != nil {
+		return shim.Error("Error 7 " + err.Error())
+	}
+	return shim.Success([]byte(segmentID))
+}
+
+//=========================================================================================
+//updateSegment - Function to record the progress of a trip segment
+//Arguments: trip ID or ticket number, segment ID, status (In Transit, Completed, Cancelled),
+//actual departure, actual arrival, price (optional)
+//=========================================================================================
+func (t *SimpleChaincode) updateSegment(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 6 {
+		return shim.Error("Incorrect number of arguments, expecting 6")
+	}
+	tktID, tripBytes, err := getTrip(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	segmentKey, err := stub.CreateCompositeKey("tripSegment", []string{tktID, args[1]})
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	segmentBytes, err := stub.GetState(segmentKey)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	if segmentBytes == nil {
+		return shim.Error("Segment ID " + args[1] + " does not exist for trip ID " + tktID)
+	}
+	segmentObj := &tripSegment{}
+	err = json.Unmarshal(segmentBytes, segmentObj)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	tripObj := &tripDetails{}
+	err = json.Unmarshal(tripBytes, tripObj)
+	if err != nil {
+		return shim.Error("Error 12 " + err.Error())
+	}
+	if isTripCancelled(tripObj.Status) {
+		return shim.Error("Trip ID " + tktID + " has been cancelled")
+	}
+	//Completed and cancelled segments are final as their revenue may already have been shared
+	if segmentObj.Status == "Completed" || segmentObj.Status == "Cancelled" {
+		return shim.Error("Segment ID " + segmentObj.SegmentID + " is " + segmentObj.Status + " and cannot be updated")
+	}
+	status := args[2]
+	if status == "In Transit" {
+		segmentObj.Event = "Segment Departed"
+	} else if status == "Completed" {
+		segmentObj.Event = "Segment Completed"
+	} else if status == "Cancelled" {
+		segmentObj.Event = "Segment Cancelled"
+	} else {
+		return shim.Error("Invalid segment status " + status)
+	}
+	if args[3] != "" {
+		segmentObj.ActualDeparture, err = time.Parse(time.RFC3339, args[3])
+		if err != nil {
+			return shim.Error("Error 5 " + err.Error())
+		}
+	}
+	if args[4] != "" {
+		segmentObj.ActualArrival, err = time.Parse(time.RFC3339, args[4])
+		if err != nil {
+			return shim.Error("Error 6 " + err.Error())
+		}
+	}
+	if args[5] != "" {
+		segmentObj.Price, err = strconv.ParseFloat(args[5], 64)
+		if err != nil {
+			return shim.Error("Error 7 " + err.Error())
+		}
+		if segmentObj.Price < 0 {
+			return shim.Error("Segment price cannot be negative")
+		}
+	}
+	if status == "Completed" {
+		txTimestamp, err := stub.GetTxTimestamp()
+		if err != nil {
+			return shim.Error("Error 8 " + err.Error())
+		}
+		segmentObj.CompletedDate = time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+		//Rider earns loyalty points for every completed segment
+		err = accrueLoyaltyPoints(stub, tripObj.RiderID, segmentObj.Price)
+		if err != nil {
+			return shim.Error("Error 13 " + err.Error())
+		}
+	}
+	segmentObj.Status = status
+	err = putTripSegment(stub, segmentObj)
+	if err != nil {
+		return shim.Error("Error 9 " + err.Error())
+	}
+	//Progress of the segment moves the trip along its lifecycle
+	err = advanceTripWithSegment(stub, tktID, tripObj, segmentObj)
+	if err != nil {
+		return shim.Error("Error 14 " + err.Error())
+	}
+	segmentNewBytes, err := json.Marshal(segmentObj)
+	if err != nil {
+		return shim.Error("Error 10 " + err.Error())
+	}
+	err = stub.SetEvent(segmentObj.Event, segmentNewBytes)
+	if err != nil {
+		return shim.Error("Error 11 " + err.Error())
+	}
+	return shim.Success(segmentNewBytes)
+}
+
+//===========================================================
+//querySegments - Function to query the segments of a trip
+//===========================================================
+func (t *SimpleChaincode) querySegments(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	tktID, _, err := getTrip(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	segments, err := getTripSegments(stub, tktID)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	segmentBytes, err := json.Marshal(segments)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	return shim.Success(segmentBytes)
+}
+
+//=====================================================================
+//getTripSegments - Common Function to get the segments of a trip
+//in the order they were added
+//=====================================================================
+func getTripSegments(stub shim.ChaincodeStubInterface, tktID string) ([]tripSegment, error) {
+	segmentIterator, err := stub.GetStateByPartialCompositeKey("tripSegment", []string{tktID})
+	if err != nil {
+		return nil, err
+	}
+	defer segmentIterator.Close()
+	segments := []tripSegment{}
+	for segmentIterator.HasNext() {
+		segmentResponse, err := segmentIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		segmentObj := tripSegment{}
+		err = json.Unmarshal(segmentResponse.Value, &segmentObj)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segmentObj)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].SeqNo < segments[j].SeqNo
+	})
+	return segments, nil
+}
+
+func putTripSegment(stub shim.ChaincodeStubInterface, segmentObj *tripSegment) error {
+	segmentKey, err := stub.CreateCompositeKey("tripSegment", []string{segmentObj.TktID, segmentObj.SegmentID})
+	if err != nil {
+		return err
+	}
+	segmentBytes, err := json.Marshal(segmentObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(segmentKey, segmentBytes)
+}
+
+//=========================================================================================
+//registerLocation - Function to register a station, stop or city in the location registry
+//Arguments: location ID, name, location type (Station, Stop, City), city, country, region,
+//latitude, longitude
+//=========================================================================================
+func (t *SimpleChaincode) registerLocation(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 8 {
+		return shim.Error("Incorrect number of arguments, expecting 8")
+	}
+	//Only administrators can maintain the location registry
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	locationID := args[0]
+	name := args[1]
+	locationType := args[2]
+	if locationID == "" || name == "" || args[4] == "" || args[5] == "" {
+		return shim.Error("Location ID, name, country and region cannot be null")
+	}
+	if locationType != "Station" && locationType != "Stop" && locationType != "City" {
+		return shim.Error("Invalid location type " + locationType)
+	}
+	latitude, err := strconv.ParseFloat(args[6], 64)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	longitude, err := strconv.ParseFloat(args[7], 64)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return shim.Error("Invalid coordinates")
+	}
+	//Remove the name and region index entries of a location being re-registered
+	existingObj, err := getLocation(stub, locationID)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	if existingObj != nil {
+		err = deleteLocationIndexes(stub, existingObj)
+		if err != nil {
+			return shim.Error("Error 5 " + err.Error())
+		}
+	}
+	//A location name must identify a single location
+	nameKey, err := stub.CreateCompositeKey("locationName", []string{strings.ToUpper(name)})
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	nameBytes, err := stub.GetState(nameKey)
+	if err != nil {
+		return shim.Error("Error 7 " + err.Error())
+	}
+	if nameBytes != nil && string(nameBytes) != locationID {
+		return shim.Error("Location name " + name + " is already registered as " + string(nameBytes))
+	}
+
+	objectType := "Location"
+	locationObj := &location{objectType, locationID, name, locationType, args[3], args[4], args[5], latitude, longitude}
+	locationBytes, err := json.Marshal(locationObj)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	locationKey, err := stub.CreateCompositeKey("location", []string{locationID})
+	if err != nil {
+		return shim.Error("Error 9 " + err.Error())
+	}
+	err = stub.PutState(locationKey, locationBytes)
+	if err != nil {
+		return shim.Error("Error 10 " + err.Error())
+	}
+	err = stub.PutState(nameKey, []byte(locationID))
+	if err != nil {
+		return shim.Error("Error 11 " + err.Error())
+	}
+	regionKey, err := stub.CreateCompositeKey("locationRegion", []string{strings.ToUpper(locationObj.Region), locationID})
+	if err != nil {
+		return shim.Error("Error 12 " + err.Error())
+	}
+	err = stub.PutState(regionKey, []byte(locationID))
+	if err != nil {
+		return shim.Error("Error 13 " + err.Error())
+	}
+	return shim.Success(locationBytes)
+}
+
+//=====================================================================================
+//queryLocations - Function to query the location registry, optionally for a region
+//=====================================================================================
+func (t *SimpleChaincode) queryLocations(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("[")
+	if len(args) > 0 && args[0] != "" {
+		regionIterator, err := stub.GetStateByPartialCompositeKey("locationRegion", []string{strings.ToUpper(args[0])})
+		if err != nil {
+			return shim.Error("Error 1 " + err.Error())
+		}
+		defer regionIterator.Close()
+		for regionIterator.HasNext() {
+			response, err := regionIterator.Next()
+			if err != nil {
+				return shim.Error("Error 2 " + err.Error())
+			}
+			locationObj, err := getLocation(stub, string(response.Value))
+			if err != nil {
+				return shim.Error("Error 3 " + err.Error())
+			}
+			if locationObj == nil {
+				continue
+			}
+			locationBytes, err := json.Marshal(locationObj)
+			if err != nil {
+				return shim.Error("Error 4 " + err.Error())
+			}
+			if isRecordWritten == true {
+				buffer.WriteString(",")
+			}
+			buffer.Write(locationBytes)
+			isRecordWritten = true
+		}
+	} else {
+		locationIterator, err := stub.GetStateByPartialCompositeKey("location", []string{})
+		if err != nil {
+			return shim.Error("Error 5 " + err.Error())
+		}
+		defer locationIterator.Close()
+		for locationIterator.HasNext() {
+			response, err := locationIterator.Next()
+			if err != nil {
+				return shim.Error("Error 6 " + err.Error())
+			}
+			if isRecordWritten == true {
+				buffer.WriteString(",")
+			}
+			buffer.Write(response.Value)
+			isRecordWritten = true
+		}
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+func getLocation(stub shim.ChaincodeStubInterface, locationID string) (*location, error) {
+	locationKey, err := stub.CreateCompositeKey("location", []string{locationID})
+	if err != nil {
+		return nil, err
+	}
+	locationBytes, err := stub.GetState(locationKey)
+	if err != nil {
+		return nil, err
+	}
+	if locationBytes == nil {
+		return nil, nil
+	}
+	locationObj := &location{}
+	err = json.Unmarshal(locationBytes, locationObj)
+	if err != nil {
+		return nil, err
+	}
+	return locationObj, nil
+}
+
+func deleteLocationIndexes(stub shim.ChaincodeStubInterface, locationObj *location) error {
+	nameKey, err := stub.CreateCompositeKey("locationName", []string{strings.ToUpper(locationObj.Name)})
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(nameKey)
+	if err != nil {
+		return err
+	}
+	regionKey, err := stub.CreateCompositeKey("locationRegion", []string{strings.ToUpper(locationObj.Region), locationObj.LocationID})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(regionKey)
+}
+
+//==================================================================================
+//resolveLocation - Common Function to look up a location by its ID or its name
+//==================================================================================
+func resolveLocation(stub shim.ChaincodeStubInterface, locationRef string) (*location, error) {
+	locationObj, err := getLocation(stub, locationRef)
+	if err != nil {
+		return nil, err
+	}
+	if locationObj != nil {
+		return locationObj, nil
+	}
+	nameKey, err := stub.CreateCompositeKey("locationName", []string{strings.ToUpper(locationRef)})
+	if err != nil {
+		return nil, err
+	}
+	locationID, err := stub.GetState(nameKey)
+	if err != nil {
+		return nil, err
+	}
+	if locationID != nil {
+		locationObj, err = getLocation(stub, string(locationID))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if locationObj == nil {
+		return nil, fmt.Errorf("Location %s is not registered", locationRef)
+	}
+	return locationObj, nil
+}
+
+//==================================================================================
+//getTripGeography - Common Function to validate the trip locations and derive
+//the trip geography from the region of the destination
+//==================================================================================
+func getTripGeography(stub shim.ChaincodeStubInterface, fromLOC string, toLOC string) (string, error) {
+	_, err := resolveLocation(stub, fromLOC)
+	if err != nil {
+		return "", err
+	}
+	toLocation, err := resolveLocation(stub, toLOC)
+	if err != nil {
+		return "", err
+	}
+	return toLocation.Region, nil
+}
+
+//==================================================================================
+//getRegisteredRegion - Common Function to get the region as registered for the
+//locations of the registry
+//==================================================================================
+func getRegisteredRegion(stub shim.ChaincodeStubInterface, region string) (string, error) {
+	regionIterator, err := stub.GetStateByPartialCompositeKey("locationRegion", []string{strings.ToUpper(region)})
+	if err != nil {
+		return "", err
+	}
+	defer regionIterator.Close()
+	if !regionIterator.HasNext() {
+		return "", fmt.Errorf("Region %s has no registered locations", region)
+	}
+	response, err := regionIterator.Next()
+	if err != nil {
+		return "", err
+	}
+	locationObj, err := getLocation(stub, string(response.Value))
+	if err != nil {
+		return "", err
+	}
+	if locationObj == nil {
+		return "", fmt.Errorf("Region %s has no registered locations", region)
+	}
+	return locationObj.Region, nil
+}
+
+//=========================================================================================
+//setLoyaltyProgram - Function to set the loyalty points a rider earns for a completed segment
+//Arguments: points per segment, points per unit of segment price
+//=========================================================================================
+func (t *SimpleChaincode) setLoyaltyProgram(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	//Only administrators can change the loyalty program
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	pointsPerSegment, err := strconv.Atoi(args[0])
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	pointsPerUnit, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		pointsPerUnit = 0
+	}
+	if pointsPerSegment < 0 || pointsPerUnit < 0 {
+		return shim.Error("Loyalty points cannot be negative")
+	}
+	objectType := "Loyalty Program"
+	programObj := &loyaltyProgram{objectType, pointsPerSegment, pointsPerUnit}
+	programBytes, err := json.Marshal(programObj)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	err = stub.PutState("LoyaltyProgram", programBytes)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	return shim.Success(programBytes)
+}
+
+//==================================================================
+//queryLoyaltyAccount - Function to query the loyalty points of a rider
+//==================================================================
+func (t *SimpleChaincode) queryLoyaltyAccount(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	accountObj, err := getLoyaltyAccount(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	accountBytes, err := json.Marshal(accountObj)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	return shim.Success(accountBytes)
+}
+
+func getLoyaltyAccount(stub shim.ChaincodeStubInterface, riderID string) (*loyaltyAccount, error) {
+	accountKey, err := stub.CreateCompositeKey("loyaltyAccount", []string{riderID})
+	if err != nil {
+		return nil, err
+	}
+	accountBytes, err := stub.GetState(accountKey)
+	if err != nil {
+		return nil, err
+	}
+	if accountBytes == nil {
+		return &loyaltyAccount{"Loyalty Account", riderID, 0, 0, 0}, nil
+	}
+	accountObj := &loyaltyAccount{}
+	err = json.Unmarshal(accountBytes, accountObj)
+	if err != nil {
+		return nil, err
+	}
+	return accountObj, nil
+}
+
+func putLoyaltyAccount(stub shim.ChaincodeStubInterface, accountObj *loyaltyAccount) error {
+	accountKey, err := stub.CreateCompositeKey("loyaltyAccount", []string{accountObj.RiderID})
+	if err != nil {
+		return err
+	}
+	accountBytes, err := json.Marshal(accountObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(accountKey, accountBytes)
+}
+
+//=====================================================================================
+//accrueLoyaltyPoints - Common Function to credit the rider with the loyalty points of
+//a completed segment, 10 points per segment apply until a loyalty program is set
+//=====================================================================================
+func accrueLoyaltyPoints(stub shim.ChaincodeStubInterface, riderID string, segmentPrice float64) error {
+	if riderID == "" {
+		return nil
+	}
+	programObj := &loyaltyProgram{"Loyalty Program", 10, 0}
+	programBytes, err := stub.GetState("LoyaltyProgram")
+	if err != nil {
+		return err
+	}
+	if programBytes != nil {
+		err = json.Unmarshal(programBytes, programObj)
+		if err != nil {
+			return err
+		}
+	}
+	points := programObj.PointsPerSegment + int(math.Floor(segmentPrice*programObj.PointsPerUnit))
+	if points <= 0 {
+		return nil
+	}
+	accountObj, err := getLoyaltyAccount(stub, riderID)
+	if err != nil {
+		return err
+	}
+	accountObj.Points = accountObj.Points + points
+	accountObj.PointsAccrued = accountObj.PointsAccrued + points
+	return putLoyaltyAccount(stub, accountObj)
+}
+
+//=========================================================================================
+//defineOffer - Function for an operator to define an offer riders can redeem on a trip
+//Arguments: offer ID, description, eligible booking products or operators (comma separated,
+//empty for all), minimum trip price, points required, discount, currency, expiry date,
+//budget, co-funding operators (operator:share%, comma separated, empty if fully funded
+//by the invoking operator)
+//=========================================================================================
+func (t *SimpleChaincode) defineOffer(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 10 {
+		return shim.Error("Incorrect number of arguments, expecting 10")
+	}
+	offerID := args[0]
+	if offerID == "" {
+		return shim.Error("Offer ID cannot be null")
+	}
+	operator, _, err := getInvokingStakeholder(stub)
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	existingObj, err := getOffer(stub, offerID)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	budgetUsed := 0.0
+	if existingObj != nil {
+		if existingObj.Operator != operator {
+			return shim.Error("Offer ID " + offerID + " belongs to " + existingObj.Operator)
+		}
+		budgetUsed = existingObj.BudgetUsed
+	}
+	eligibleProducts := []string{}
+	if args[2] != "" {
+		productList := strings.Split(args[2], ",")
+		var i int
+		for i = 0; i < len(productList); i++ {
+			eligibleProducts = append(eligibleProducts, strings.TrimSpace(productList[i]))
+		}
+	}
+	minTripPrice, err := strconv.ParseFloat(args[3], 64)
+	if err != nil {
+		minTripPrice = 0
+	}
+	pointsRequired, err := strconv.Atoi(args[4])
+	if err != nil {
+		pointsRequired = 0
+	}
+	discount, err := strconv.ParseFloat(args[5], 64)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	currency := strings.ToUpper(args[6])
+	if discount <= 0 || currency == "" {
+		return shim.Error("Offer discount must be positive and have a currency")
+	}
+	expiryDate, err := time.Parse("2006-01-02", args[7])
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	budget, err := strconv.ParseFloat(args[8], 64)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	if budget < budgetUsed {
+		return shim.Error("Offer budget cannot be lower than the budget already used")
+	}
+	funders := []offerFunder{}
+	totalShare := 0.0
+	if args[9] != "" {
+		funderList := strings.Split(args[9], ",")
+		var i int
+		for i = 0; i < len(funderList); i++ {
+			funderValues := strings.Split(strings.TrimSpace(funderList[i]), ":")
+			if len(funderValues) != 2 {
+				return shim.Error("Invalid offer funder " + funderList[i])
+			}
+			sharePercentage, err := strconv.ParseFloat(funderValues[1], 64)
+			if err != nil {
+				return shim.Error("Error 6 " + err.Error())
+			}
+			if sharePercentage <= 0 {
+				return shim.Error("Offer funding share must be positive")
+			}
+			funders = append(funders, offerFunder{funderValues[0], sharePercentage})
+			totalShare = totalShare + sharePercentage
+		}
+		if math.Abs(totalShare-100) > 0.001 {
+			return shim.Error("Offer funding shares must add up to 100")
+		}
+	} else {
+		funders = append(funders, offerFunder{operator, 100})
+	}
+
+	objectType := "Offer"
+	offerObj := &offer{objectType, offerID, operator, args[1], eligibleProducts, minTripPrice, pointsRequired, discount, currency, expiryDate, budget, budgetUsed, funders}
+	err = putOffer(stub, offerObj)
+	if err != nil {
+		return shim.Error("Error 7 " + err.Error())
+	}
+	offerBytes, err := json.Marshal(offerObj)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	return shim.Success(offerBytes)
+}
+
+//==========================================================================
+//queryOffers - Function to query the offers, optionally of an operator
+//==========================================================================
+func (t *SimpleChaincode) queryOffers(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	offerIterator, err := stub.GetStateByPartialCompositeKey("offer", []string{})
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	defer offerIterator.Close()
+
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("[")
+	for offerIterator.HasNext() {
+		response, err := offerIterator.Next()
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		if len(args) > 0 && args[0] != "" {
+			offerObj := &offer{}
+			err = json.Unmarshal(response.Value, offerObj)
+			if err != nil {
+				return shim.Error("Error 3 " + err.Error())
+			}
+			if offerObj.Operator != args[0] {
+				continue
+			}
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Value)
+		isRecordWritten = true
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+func getOffer(stub shim.ChaincodeStubInterface, offerID string) (*offer, error) {
+	offerKey, err := stub.CreateCompositeKey("offer", []string{offerID})
+	if err != nil {
+		return nil, err
+	}
+	offerBytes, err := stub.GetState(offerKey)
+	if err != nil {
+		return nil, err
+	}
+	if offerBytes == nil {
+		return nil, nil
+	}
+	offerObj := &offer{}
+	err = json.Unmarshal(offerBytes, offerObj)
+	if err != nil {
+		return nil, err
+	}
+	return offerObj, nil
+}
+
+func putOffer(stub shim.ChaincodeStubInterface, offerObj *offer) error {
+	offerKey, err := stub.CreateCompositeKey("offer", []string{offerObj.OfferID})
+	if err != nil {
+		return err
+	}
+	offerBytes, err := json.Marshal(offerObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(offerKey, offerBytes)
+}
+
+//=========================================================================================
+//redeemOffer - Function to redeem an offer on a trip against the loyalty points of the rider
+//Arguments: trip ID or ticket number, offer ID
+//=========================================================================================
+func (t *SimpleChaincode) redeemOffer(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	tktID, tripBytes, err := getTrip(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	tripObj := &tripDetails{}
+	err = json.Unmarshal(tripBytes, tripObj)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if isTripCancelled(tripObj.Status) {
+		return shim.Error("Trip ID " + tktID + " has been cancelled")
+	}
+	offerObj, err := getOffer(stub, args[1])
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	if offerObj == nil {
+		return shim.Error("Offer ID " + args[1] + " does not exist")
+	}
+	//Points can only be redeemed by the rider, the booking operator or the operator of the offer
+	err = checkRedemptionInvoker(stub, tripObj, offerObj)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	redemptionDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	//Validate the eligibility of the trip for the offer
+	if !redemptionDate.Before(offerObj.ExpiryDate.AddDate(0, 0, 1)) {
+		return shim.Error("Offer ID " + offerObj.OfferID + " has expired")
+	}
+	redemptionKey, err := stub.CreateCompositeKey("offerRedemption", []string{offerObj.OfferID, tktID})
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	redemptionBytes, err := stub.GetState(redemptionKey)
+	if err != nil {
+		return shim.Error("Error 7 " + err.Error())
+	}
+	if redemptionBytes != nil {
+		return shim.Error("Offer ID " + offerObj.OfferID + " has already been redeemed on trip ID " + tktID)
+	}
+	if len(offerObj.EligibleProducts) > 0 {
+		isEligible := false
+		var i int
+		for i = 0; i < len(offerObj.EligibleProducts); i++ {
+			if offerObj.EligibleProducts[i] == tripObj.BookedUsingProduct || strings.Contains(tripObj.Products, offerObj.EligibleProducts[i]) {
+				isEligible = true
+				break
+			}
+		}
+		if !isEligible {
+			return shim.Error("Trip ID " + tktID + " is not eligible for offer ID " + offerObj.OfferID)
+		}
+	}
+	tripPrice, err := convertAmount(stub, tripObj.Price, tripObj.Currency, offerObj.Currency, redemptionDate)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	if tripPrice < offerObj.MinTripPrice {
+		return shim.Error("Trip ID " + tktID + " does not meet the minimum trip price of offer ID " + offerObj.OfferID)
+	}
+	//The discount applied is capped at the trip price, the offer budget and the funders are
+	//charged for the discount applied in the currency of the offer
+	tripDiscount, err := convertAmount(stub, offerObj.Discount, offerObj.Currency, tripObj.Currency, redemptionDate)
+	if err != nil {
+		return shim.Error("Error 9 " + err.Error())
+	}
+	offerDiscount := offerObj.Discount
+	if tripDiscount > tripObj.Price {
+		tripDiscount = tripObj.Price
+		offerDiscount, err = convertAmount(stub, tripDiscount, tripObj.Currency, offerObj.Currency, redemptionDate)
+		if err != nil {
+			return shim.Error("Error 9 " + err.Error())
+		}
+	}
+	tripDiscount = math.Round(tripDiscount*100) / 100
+	//The discount cannot exceed the remaining budget of the offer
+	if offerObj.BudgetUsed+offerDiscount > offerObj.Budget+0.001 {
+		return shim.Error("Offer ID " + offerObj.OfferID + " has no remaining budget")
+	}
+	accountObj, err := getLoyaltyAccount(stub, tripObj.RiderID)
+	if err != nil {
+		return shim.Error("Error 10 " + err.Error())
+	}
+	if accountObj.Points < offerObj.PointsRequired {
+		return shim.Error("Rider " + tripObj.RiderID + " does not have enough loyalty points for offer ID " + offerObj.OfferID)
+	}
+
+	//Book the cost of the discount to the funders of the offer as negative revenue shares,
+	//the last funder takes the rounding difference
+	if tripObj.RevenueEarnedCurrency == "" {
+		tripObj.RevenueEarnedCurrency, err = getReportingCurrency(stub, tripObj.BookedUsingProduct, tripObj.Currency)
+		if err != nil {
+			return shim.Error("Error 11 " + err.Error())
+		}
+	}
+	fundedShares := []offerFunded{}
+	remainingTripDiscount := tripDiscount
+	remainingOfferDiscount := offerDiscount
+	var i int
+	for i = 0; i < len(offerObj.Funders); i++ {
+		tripFunded := math.Round(tripDiscount*offerObj.Funders[i].SharePercentage) / 100
+		fundedAmount := math.Round(offerDiscount*offerObj.Funders[i].SharePercentage) / 100
+		if i == len(offerObj.Funders)-1 {
+			tripFunded = remainingTripDiscount
+			fundedAmount = remainingOfferDiscount
+		}
+		remainingTripDiscount = math.Round((remainingTripDiscount-tripFunded)*100) / 100
+		remainingOfferDiscount = math.Round((remainingOfferDiscount-fundedAmount)*100) / 100
+		revShareObj, revenueEarnedRev, err := getOfferFundingShare(stub, tktID, tripObj.BookedUsingProduct, offerObj.Funders[i].Operator, offerObj.OfferID, tripFunded, tripObj.Currency, tripObj.RevenueEarnedCurrency, redemptionDate)
+		if err != nil {
+			return shim.Error("Error 12 " + err.Error())
+		}
+		tripObj.RevenueSharing = append(tripObj.RevenueSharing, revShareObj)
+		tripObj.RevenueEarned = math.Round((tripObj.RevenueEarned+revenueEarnedRev)*100) / 100
+		fundedShares = append(fundedShares, offerFunded{offerObj.Funders[i].Operator, fundedAmount})
+		err = addOfferFunding(stub, offerObj.Funders[i].Operator, offerObj.OfferID, offerObj.Currency, fundedAmount)
+		if err != nil {
+			return shim.Error("Error 13 " + err.Error())
+		}
+	}
+	tripObj.Price = math.Round((tripObj.Price-tripDiscount)*100) / 100
+	tripObj.DiscountAmount = math.Round((tripObj.DiscountAmount+tripDiscount)*100) / 100
+	tripBytes, err = json.Marshal(tripObj)
+	if err != nil {
+		return shim.Error("Error 14 " + err.Error())
+	}
+	err = stub.PutState(tktID, tripBytes)
+	if err != nil {
+		return shim.Error("Error 15 " + err.Error())
+	}
+
+	//Debit the loyalty points and the offer budget
+	accountObj.Points = accountObj.Points - offerObj.PointsRequired
+	accountObj.PointsRedeemed = accountObj.PointsRedeemed + offerObj.PointsRequired
+	err = putLoyaltyAccount(stub, accountObj)
+	if err != nil {
+		return shim.Error("Error 16 " + err.Error())
+	}
+	offerObj.BudgetUsed = math.Round((offerObj.BudgetUsed+offerDiscount)*100) / 100
+	err = putOffer(stub, offerObj)
+	if err != nil {
+		return shim.Error("Error 17 " + err.Error())
+	}
+
+	objectType := "Offer Redemption"
+	redemptionObj := &offerRedemption{objectType, offerObj.OfferID, tktID, tripObj.RiderID, offerDiscount, offerObj.Currency, offerObj.PointsRequired, fundedShares, redemptionDate}
+	redemptionBytes, err = json.Marshal(redemptionObj)
+	if err != nil {
+		return shim.Error("Error 18 " + err.Error())
+	}
+	err = stub.PutState(redemptionKey, redemptionBytes)
+	if err != nil {
+		return shim.Error("Error 19 " + err.Error())
+	}
+	err = stub.SetEvent("Offer Redeemed", redemptionBytes)
+	if err != nil {
+		return shim.Error("Error 20 " + err.Error())
+	}
+	return shim.Success(redemptionBytes)
+}
+
+//=======================================================================================
+//getOfferFundingShare - Common Function to record the part of a discount funded by an
+//operator as a negative revenue share. The booking stakeholder bears its own part, the
+//part of another operator reduces the amount the booking stakeholder owes it
+//=======================================================================================
+func getOfferFundingShare(stub shim.ChaincodeStubInterface, tripID string, bookedBy string, funder string, offerID string, fundedAmount float64, revCurrency string, revenueEarnedCurrency string, eventDate time.Time) (revenueShare, float64, error) {
+	stakeholder1Rev := -fundedAmount
+	stakeholder2Rev := -fundedAmount
+	if bookedBy != funder {
+		stakeholder1Rev = 0
+	}
+	return newRevenueShare(stub, tripID, bookedBy, funder, -fundedAmount, stakeholder1Rev, stakeholder2Rev, offerID, revCurrency, revenueEarnedCurrency, eventDate)
+}
+
+func addOfferFunding(stub shim.ChaincodeStubInterface, operator string, offerID string, currency string, fundedAmount float64) error {
+	fundingKey, err := stub.CreateCompositeKey("offerFunding", []string{operator, offerID})
+	if err != nil {
+		return err
+	}
+	fundingBytes, err := stub.GetState(fundingKey)
+	if err != nil {
+		return err
+	}
+	fundingObj := &offerFunding{"Offer Funding", operator, offerID, currency, 0, 0}
+	if fundingBytes != nil {
+		err = json.Unmarshal(fundingBytes, fundingObj)
+		if err != nil {
+			return err
+		}
+	}
+	fundingObj.FundedAmount = math.Round((fundingObj.FundedAmount+fundedAmount)*100) / 100
+	fundingObj.NoOfRedemptions = fundingObj.NoOfRedemptions + 1
+	fundingBytes, err = json.Marshal(fundingObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(fundingKey, fundingBytes)
+}
+
+//==========================================================================================
+//queryOfferFunding - Function to query the offer costs funded by an operator, per offer
+//==========================================================================================
+func (t *SimpleChaincode) queryOfferFunding(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	if args[0] == "" {
+		return shim.Error("Operator cannot be null")
+	}
+	fundingIterator, err := stub.GetStateByPartialCompositeKey("offerFunding", []string{args[0]})
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	defer fundingIterator.Close()
+
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("[")
+	for fundingIterator.HasNext() {
+		response, err := fundingIterator.Next()
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Value)
+		isRecordWritten = true
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+//=========================================================================================
+//getAllowedTripStatuses - Common Function to get the statuses a trip can move to next
+//Booked -> CheckedIn -> InTransit -> SegmentCompleted -> Completed, a trip that has not
+//completed can be cancelled and a cancelled trip is refunded
+//=========================================================================================
+func getAllowedTripStatuses(status string) []string {
+	if status == "Booked" {
+		return []string{"CheckedIn", "InTransit", "Cancelled"}
+	} else if status == "CheckedIn" {
+		return []string{"InTransit", "Cancelled"}
+	} else if status == "InTransit" {
+		return []string{"SegmentCompleted", "Completed", "Cancelled"}
+	} else if status == "SegmentCompleted" {
+		return []string{"InTransit", "Completed", "Cancelled"}
+	} else if status == "Cancelled" {
+		return []string{"Refunded"}
+	}
+	return []string{}
+}
+
+//=========================================================================================
+//normalizeTripStatus - Common Function to map a status to the trip lifecycle, ignoring
+//case and separators so that "Checked In" is CheckedIn, unknown statuses map to ""
+//=========================================================================================
+func normalizeTripStatus(status string) string {
+	statuses := []string{"Booked", "CheckedIn", "InTransit", "SegmentCompleted", "Completed", "Cancelled", "Refunded"}
+	replacer := strings.NewReplacer(" ", "", "-", "", "_", "")
+	status = replacer.Replace(status)
+	var i int
+	for i = 0; i < len(statuses); i++ {
+		if strings.EqualFold(status, statuses[i]) {
+			return statuses[i]
+		}
+	}
+	return ""
+}
+
+//Trips recorded before the lifecycle was enforced are treated as booked unless recognized
+func getTripStatus(tripObj *tripDetails) string {
+	status := normalizeTripStatus(tripObj.Status)
+	if status == "" {
+		return "Booked"
+	}
+	return status
+}
+
+func isTripCancelled(status string) bool {
+	status = normalizeTripStatus(status)
+	return status == "Cancelled" || status == "Refunded"
+}
+
+func newTripTransition(stub shim.ChaincodeStubInterface, fromStatus string, toStatus string, event string) (tripTransition, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return tripTransition{}, err
+	}
+	return tripTransition{fromStatus, toStatus, event, stub.GetTxID(), time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()}, nil
+}
+
+//=========================================================================================
+//transitionTrip - Common Function to move a trip to a status of its lifecycle, the
+//transition is recorded on the trip, moving to the current status records nothing
+//=========================================================================================
+func transitionTrip(stub shim.ChaincodeStubInterface, tripObj *tripDetails, status string, event string) error {
+	toStatus := normalizeTripStatus(status)
+	if toStatus == "" {
+		return fmt.Errorf("Invalid trip status %s", status)
+	}
+	fromStatus := getTripStatus(tripObj)
+	if toStatus != fromStatus {
+		allowedStatuses := getAllowedTripStatuses(fromStatus)
+		isAllowed := false
+		var i int
+		for i = 0; i < len(allowedStatuses); i++ {
+			if allowedStatuses[i] == toStatus {
+				isAllowed = true
+				break
+			}
+		}
+		if !isAllowed {
+			return fmt.Errorf("Trip ID %s cannot move from %s to %s", tripObj.TktID, fromStatus, toStatus)
+		}
+		transition, err := newTripTransition(stub, fromStatus, toStatus, event)
+		if err != nil {
+			return err
+		}
+		tripObj.Transitions = append(tripObj.Transitions, transition)
+	}
+	tripObj.Status = toStatus
+	tripObj.Progress = toStatus
+	return nil
+}
+
+//=========================================================================================
+//advanceTripWithSegment - Common Function to move the trip to in transit when a segment
+//departs and to segment completed or completed when a segment is completed
+//=========================================================================================
+func advanceTripWithSegment(stub shim.ChaincodeStubInterface, tktID string, tripObj *tripDetails, segmentObj *tripSegment) error {
+	var status string
+	if segmentObj.Status == "In Transit" {
+		status = "InTransit"
+	} else if segmentObj.Status == "Completed" {
+		segments, err := getTripSegments(stub, tktID)
+		if err != nil {
+			return err
+		}
+		status = "Completed"
+		var i int
+		for i = 0; i < len(segments); i++ {
+			if segments[i].Status != "Completed" && segments[i].Status != "Cancelled" {
+				status = "SegmentCompleted"
+				break
+			}
+		}
+		//A segment completed without a recorded departure has been in transit
+		currentStatus := getTripStatus(tripObj)
+		if currentStatus == "Booked" || currentStatus == "CheckedIn" {
+			err = transitionTrip(stub, tripObj, "InTransit", segmentObj.Event)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		return nil
+	}
+	err := transitionTrip(stub, tripObj, status, segmentObj.Event)
+	if err != nil {
+		return err
+	}
+	tripObj.Event = segmentObj.Event
+	tripBytes, err := json.Marshal(tripObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(tktID, tripBytes)
+}
+
+//=========================================================================================
+//getAllowedTripTransitions - Function to query the statuses a trip can move to next
+//=========================================================================================
+func (t *SimpleChaincode) getAllowedTripTransitions(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	tktID, tripBytes, err := getTrip(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	tripObj := &tripDetails{}
+	err = json.Unmarshal(tripBytes, tripObj)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	status := getTripStatus(tripObj)
+	transitionsObj := map[string]interface{}{
+		"tktID":              tktID,
+		"status":             status,
+		"allowedTransitions": getAllowedTripStatuses(status),
+		"transitions":        tripObj.Transitions,
+	}
+	transitionsBytes, err := json.Marshal(transitionsObj)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	return shim.Success(transitionsBytes)
+}
+
+//=========================================================================================
+//markTripRefunded - Function to record that the refund of a cancelled trip has been paid
+//=========================================================================================
+func (t *SimpleChaincode) markTripRefunded(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	tktID, tripBytes, err := getTrip(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	tripObj := &tripDetails{}
+	err = json.Unmarshal(tripBytes, tripObj)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	err = transitionTrip(stub, tripObj, "Refunded", "Trip Refunded")
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	tripObj.Event = "Trip Refunded"
+	tripNewBytes, err := json.Marshal(tripObj)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	err = stub.PutState(tktID, tripNewBytes)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	err = stub.SetEvent(tripObj.Event, tripNewBytes)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	return shim.Success(tripNewBytes)
+}
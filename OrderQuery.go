@@ -5,11 +5,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"github.com/hyperledger/fabric/protos/peer"
 )
@@ -132,6 +134,128 @@ type WorkOrder struct {
 	Custody      string `json:"custody"`
 	Count        int    `json:"count"`
 }
+type eventDefinition struct {
+	ObjectType        string   `json:"objectType"`
+	EventName         string   `json:"eventName"`
+	StageCode         string   `json:"stageCode"`
+	Category          string   `json:"category"`
+	MessageTemplate   string   `json:"messageTemplate"`
+	AllowedChaincodes []string `json:"allowedChaincodes"`
+}
+type userProfile struct {
+	ProfileID         string `json:"profileID"`
+	PreferredLanguage string `json:"preferredLanguage"`
+}
+
+type orderETA struct {
+	OrderID               string    `json:"orderID"`
+	Origin                string    `json:"origin"`
+	Destination           string    `json:"destination"`
+	Shipper               string    `json:"shipper"`
+	StageCode             string    `json:"stageCode"`
+	StageDate             time.Time `json:"stageDate"`
+	EstimatedDeliveryDate time.Time `json:"estimatedDeliveryDate"`
+	EarliestDeliveryDate  time.Time `json:"earliestDeliveryDate"`
+	LatestDeliveryDate    time.Time `json:"latestDeliveryDate"`
+	ExpectedDeliveryDate  time.Time `json:"expectedDeliveryDate"`
+	VarianceHours         float64   `json:"varianceHours"`
+	SampleCount           int       `json:"sampleCount"`
+	Confidence            string    `json:"confidence"`
+	Status                string    `json:"status"`
+}
+
+type timelineEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
+	OrderID   string    `json:"orderID"`
+	Event     string    `json:"event"`
+	Code      string    `json:"code"`
+	Category  string    `json:"category"`
+	Actor     string    `json:"actor"`
+	TxID      string    `json:"txID"`
+}
+
+//History entry as returned by queryTrxHistory of the order chaincodes
+type historyEntry struct {
+	TxID      string          `json:"Transaction ID"`
+	Value     json.RawMessage `json:"Value"`
+	TimeStamp string          `json:"TimeStamp"`
+	IsDelete  string          `json:"IsDelete"`
+}
+
+type tracedOrder struct {
+	ID           string `json:"id"`
+	OrderType    string `json:"orderType"`
+	Event        string `json:"event"`
+	EventCode    string `json:"eventCode"`
+	Chaincode    string `json:"chaincode"`
+	Channel      string `json:"channel"`
+	LotNumber    string `json:"lotNumber"`
+	SerialNumber string `json:"serialNumber"`
+}
+
+type lotTrace struct {
+	LotNumber         string        `json:"lotNumber"`
+	Orders            []tracedOrder `json:"orders"`
+	IncompleteSources []string      `json:"incompleteSources"`
+}
+
+type inputTrace struct {
+	OrderID       string        `json:"orderID"`
+	LotNumbers    []string      `json:"lotNumbers"`
+	SerialNumbers []string      `json:"serialNumbers"`
+	Inputs        []tracedOrder `json:"inputs"`
+}
+
+type orderGraph struct {
+	RootID    string            `json:"rootID"`
+	Depth     int               `json:"depth"`
+	Nodes     []graphNode       `json:"nodes"`
+	Edges     []graphEdge       `json:"edges"`
+	Truncated []truncatedBranch `json:"truncated"`
+	Notes     []string          `json:"notes"`
+}
+type graphNode struct {
+	ID        string          `json:"id"`
+	NodeType  string          `json:"nodeType"`
+	Event     string          `json:"event"`
+	EventCode string          `json:"eventCode"`
+	Chaincode string          `json:"chaincode"`
+	Channel   string          `json:"channel"`
+	Level     int             `json:"level"`
+	State     json.RawMessage `json:"state"`
+}
+type graphEdge struct {
+	From         string `json:"from"`
+	To           string `json:"to"`
+	Relationship string `json:"relationship"`
+}
+type traversalLimits struct {
+	MaxDepth int `json:"maxDepth"`
+	MaxNodes int `json:"maxNodes"`
+}
+type profileSource struct {
+	Chaincode string `json:"chaincode"`
+	Channel   string `json:"channel"`
+	Attribute string `json:"attribute"`
+}
+type orderTraversal struct {
+	Limits    traversalLimits
+	Visited   map[string]bool
+	NodeCount int
+	Truncated []truncatedBranch
+}
+type childOrderList struct {
+	OrderID     string            `json:"orderID"`
+	ChildOrders []string          `json:"childOrders"`
+	Truncated   []truncatedBranch `json:"truncated"`
+}
+type truncatedBranch struct {
+	Truncated bool   `json:"truncated"`
+	OrderID   string `json:"orderID"`
+	OrderType string `json:"orderType"`
+	Reason    string `json:"reason"`
+}
 
 func main() {
 	err := shim.Start(new(SimpleChaincode))
@@ -148,10 +272,14 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response
 	funct, args := stub.GetFunctionAndParameters()
 	if funct == "queryOrder" {
 		if args[0] == "orderprocessing" {
+			traversal, err := newOrderTraversal(stub)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
 			if args[1] == "SO" {
-				return t.querySO(stub, args)
+				return t.querySO(stub, args, traversal, 0)
 			} else if args[1] == "PO" {
-				return t.queryPO(stub, args)
+				return t.queryPO(stub, args, traversal, 0)
 			} else {
 				return shim.Error("Incorrect order type " + args[1])
 			}
@@ -160,10 +288,14 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response
 		}
 	} else if funct == "queryChildOrders" {
 		if args[0] == "orderprocessing" {
+			traversal, err := newOrderTraversal(stub)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
 			if args[1] == "SO" {
-				return t.queryChildSO(stub, args)
+				return getChildOrderList(args[2], t.queryChildSO(stub, args, traversal, 0), traversal)
 			} else if args[1] == "PO" {
-				return t.queryChildPO(stub, args)
+				return getChildOrderList(args[2], t.queryChildPO(stub, args, traversal, 0), traversal)
 			} else {
 				return shim.Error("Incorrect order type " + args[1])
 			}
@@ -172,6 +304,20 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response
 		}
 	} else if funct == "getLatestOrderStatus" {
 		return t.getLatestOrderStatus(stub, args)
+	} else if funct == "getOrderGraph" {
+		return t.getOrderGraph(stub, args)
+	} else if funct == "setTraversalLimits" {
+		return t.setTraversalLimits(stub, args)
+	} else if funct == "setProfileSource" {
+		return t.setProfileSource(stub, args)
+	} else if funct == "getOrderETA" {
+		return t.getOrderETA(stub, args)
+	} else if funct == "getOrderTimeline" {
+		return t.getOrderTimeline(stub, args)
+	} else if funct == "traceLot" {
+		return t.traceLot(stub, args)
+	} else if funct == "traceOrderInputs" {
+		return t.traceOrderInputs(stub, args)
 	} else {
 		return shim.Error("Incorrect function name " + funct)
 	}
@@ -181,7 +327,7 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) peer.Response
 //===============================================
 //querySO - Function to query Sales Order details
 //===============================================
-func (t *SimpleChaincode) querySO(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *SimpleChaincode) querySO(stub shim.ChaincodeStubInterface, args []string, traversal *orderTraversal, depth int) peer.Response {
 
 	queryChannel := args[0]
 	//queryPar := args[1]
@@ -189,6 +335,12 @@ func (t *SimpleChaincode) querySO(stub shim.ChaincodeStubInterface, args []strin
 
 	orderID := args[2]
 
+	//Stop at orders already visited and beyond the traversal limits
+	reason := visitOrder(traversal, "SO", orderID, depth)
+	if reason != "" {
+		return shim.Success(getTruncationMarker("SO", orderID, reason))
+	}
+
 	//1. Return the transaction history for the order queried
 
 	//Check if the order exists in the world state DB
@@ -274,7 +426,7 @@ func (t *SimpleChaincode) querySO(stub shim.ChaincodeStubInterface, args []strin
 				for j = 0; j < len(childOrders); j++ {
 
 					poArray := []string{queryChannel, "PO", childOrders[j], "true"}
-					poResponse := t.queryPO(stub, poArray)
+					poResponse := t.queryPO(stub, poArray, traversal, depth+1)
 					if poResponse.Status == shim.OK {
 						if isRecWritten == true {
 							buffer.WriteString(",")
@@ -294,7 +446,7 @@ func (t *SimpleChaincode) querySO(stub shim.ChaincodeStubInterface, args []strin
 				}
 			} else {
 				poArray := []string{queryChannel, "PO", respString.String(), "true"}
-				poResponse := t.queryPO(stub, poArray)
+				poResponse := t.queryPO(stub, poArray, traversal, depth+1)
 				if poResponse.Status == shim.OK {
 					if isRecWritten == true {
 						buffer.WriteString(",")
@@ -328,13 +480,19 @@ func (t *SimpleChaincode) querySO(stub shim.ChaincodeStubInterface, args []strin
 //==================================================
 //queryPO - Function to query Purchase Order details
 //==================================================
-func (t *SimpleChaincode) queryPO(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *SimpleChaincode) queryPO(stub shim.ChaincodeStubInterface, args []string, traversal *orderTraversal, depth int) peer.Response {
 	queryChannel := args[0]
 	//queryPar := args[1]
 	var buffer bytes.Buffer
 
 	orderID := args[2]
 
+	//Stop at orders already visited and beyond the traversal limits
+	reason := visitOrder(traversal, "PO", orderID, depth)
+	if reason != "" {
+		return shim.Success(getTruncationMarker("PO", orderID, reason))
+	}
+
 	//1. Return the transaction history for the order queried
 
 	//Check if the order exists in the world state DB
@@ -419,7 +577,7 @@ func (t *SimpleChaincode) queryPO(stub shim.ChaincodeStubInterface, args []strin
 				var j int
 				for j = 0; j < len(childOrders); j++ {
 					soArray := []string{queryChannel, "SO", childOrders[j], "true"}
-					soResponse := t.querySO(stub, soArray)
+					soResponse := t.querySO(stub, soArray, traversal, depth+1)
 					if soResponse.Status == shim.OK {
 						if isRecWritten == true {
 							buffer.WriteString(",")
@@ -435,7 +593,7 @@ func (t *SimpleChaincode) queryPO(stub shim.ChaincodeStubInterface, args []strin
 				}
 			} else {
 				soArray := []string{queryChannel, "SO", respString.String(), "true"}
-				soResponse := t.querySO(stub, soArray)
+				soResponse := t.querySO(stub, soArray, traversal, depth+1)
 				if soResponse.Status == shim.OK {
 					if isRecWritten == true {
 						buffer.WriteString(",")
@@ -468,7 +626,7 @@ func (t *SimpleChaincode) queryPO(stub shim.ChaincodeStubInterface, args []strin
 //===============================================
 //querySO - Function to query Sales Order details
 //===============================================
-func (t *SimpleChaincode) queryChildSO(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *SimpleChaincode) queryChildSO(stub shim.ChaincodeStubInterface, args []string, traversal *orderTraversal, depth int) peer.Response {
 
 	queryChannel := args[0]
 	//queryPar := args[1]
@@ -476,6 +634,13 @@ func (t *SimpleChaincode) queryChildSO(stub shim.ChaincodeStubInterface, args []
 
 	orderID := args[2]
 
+	//Orders already visited and beyond the traversal limits are recorded as truncated with the reason
+	reason := visitOrder(traversal, "SO", orderID, depth)
+	if reason != "" {
+		traversal.Truncated = append(traversal.Truncated, truncatedBranch{true, orderID, "SO", reason})
+		return shim.Success(nil)
+	}
+
 	//1. Return the transaction history for the order queried
 
 	//Check if the order exists in the world state DB
@@ -554,8 +719,8 @@ func (t *SimpleChaincode) queryChildSO(stub shim.ChaincodeStubInterface, args []
 				for j = 0; j < len(childOrders); j++ {
 
 					poArray := []string{queryChannel, "PO", childOrders[j], "true"}
-					poResponse := t.queryChildPO(stub, poArray)
-					if poResponse.Status == shim.OK {
+					poResponse := t.queryChildPO(stub, poArray, traversal, depth+1)
+					if poResponse.Status == shim.OK && len(poResponse.Payload) != 0 {
 						if isRecWritten == true {
 							buffer.WriteString(",")
 						}
@@ -569,8 +734,8 @@ func (t *SimpleChaincode) queryChildSO(stub shim.ChaincodeStubInterface, args []
 				}
 			} else {
 				poArray := []string{queryChannel, "PO", respString.String(), "true"}
-				poResponse := t.queryChildPO(stub, poArray)
-				if poResponse.Status == shim.OK {
+				poResponse := t.queryChildPO(stub, poArray, traversal, depth+1)
+				if poResponse.Status == shim.OK && len(poResponse.Payload) != 0 {
 					if isRecWritten == true {
 						buffer.WriteString(",")
 					}
@@ -590,13 +755,20 @@ func (t *SimpleChaincode) queryChildSO(stub shim.ChaincodeStubInterface, args []
 //==================================================
 //queryPO - Function to query Purchase Order details
 //==================================================
-func (t *SimpleChaincode) queryChildPO(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+func (t *SimpleChaincode) queryChildPO(stub shim.ChaincodeStubInterface, args []string, traversal *orderTraversal, depth int) peer.Response {
 	queryChannel := args[0]
 	//queryPar := args[1]
 	var buffer bytes.Buffer
 
 	orderID := args[2]
 
+	//Orders already visited and beyond the traversal limits are recorded as truncated with the reason
+	reason := visitOrder(traversal, "PO", orderID, depth)
+	if reason != "" {
+		traversal.Truncated = append(traversal.Truncated, truncatedBranch{true, orderID, "PO", reason})
+		return shim.Success(nil)
+	}
+
 	//1. Return the transaction history for the order queried
 
 	//Check if the order exists in the world state DB
@@ -673,8 +845,8 @@ func (t *SimpleChaincode) queryChildPO(stub shim.ChaincodeStubInterface, args []
 				var j int
 				for j = 0; j < len(childOrders); j++ {
 					soArray := []string{queryChannel, "SO", childOrders[j], "true"}
-					soResponse := t.queryChildSO(stub, soArray)
-					if soResponse.Status == shim.OK {
+					soResponse := t.queryChildSO(stub, soArray, traversal, depth+1)
+					if soResponse.Status == shim.OK && len(soResponse.Payload) != 0 {
 						if isRecWritten == true {
 							buffer.WriteString(",")
 						}
@@ -684,8 +856,8 @@ func (t *SimpleChaincode) queryChildPO(stub shim.ChaincodeStubInterface, args []
 				}
 			} else {
 				soArray := []string{queryChannel, "SO", respString.String(), "true"}
-				soResponse := t.queryChildSO(stub, soArray)
-				if soResponse.Status == shim.OK {
+				soResponse := t.queryChildSO(stub, soArray, traversal, depth+1)
+				if soResponse.Status == shim.OK && len(soResponse.Payload) != 0 {
 					if isRecWritten == true {
 						buffer.WriteString(",")
 					}
@@ -701,10 +873,13 @@ func (t *SimpleChaincode) queryChildPO(stub shim.ChaincodeStubInterface, args []
 
 //=========================================================================================
 //getLatestOrderStatus - Function to return the latest order status for the DSCB V3 Chatbot
+//Arguments: order ID, locale (optional, defaults to the preferred language in the user
+//profile of the caller)
 //=========================================================================================
 func (t *SimpleChaincode) getLatestOrderStatus(stub shim.ChaincodeStubInterface, args []string) peer.Response {
 	orderID := args[0]
 	var soEvent, soEventCode, poEvent, poEventCode, woEvent, woEventCode, shipEvent, shipEventCode, csoEvent, csoEventCode, pShipEvent, pShipEventCode string
+	var location, eta string
 	var err error
 	//Check if purchase order ledger has entries for the order
 	poChannel := "orderprocessing"
@@ -730,6 +905,8 @@ func (t *SimpleChaincode) getLatestOrderStatus(stub shim.ChaincodeStubInterface,
 			}
 			soEventCode = soObj.Attribute2
 			soEvent = soObj.Event
+			location = soObj.CurrentLocation
+			eta = getETAString(soObj.ExpectedDeliveryDate)
 			poEventCode = "0"
 			poEvent = "No Event"
 
@@ -752,6 +929,12 @@ func (t *SimpleChaincode) getLatestOrderStatus(stub shim.ChaincodeStubInterface,
 			}
 			pShipEventCode = pShipObj.Attribute2
 			pShipEvent = pShipObj.Event
+			if len(pShipObj.CurrentLocation) != 0 {
+				location = pShipObj.CurrentLocation
+			}
+			if !pShipObj.ExpectedDeliveryDate.IsZero() {
+				eta = getETAString(pShipObj.ExpectedDeliveryDate)
+			}
 			poEventCode = "0"
 			poEvent = "No Event"
 		}
@@ -765,6 +948,8 @@ func (t *SimpleChaincode) getLatestOrderStatus(stub shim.ChaincodeStubInterface,
 		}
 		poEventCode = poObj.EventCode
 		poEvent = poObj.Event
+		location = poObj.ShipToLocation
+		eta = getETAString(poObj.RequestedDeliveryDate)
 		soEventCode = "0"
 		soEvent = "No Event"
 		pShipEventCode = "0"
@@ -842,6 +1027,12 @@ func (t *SimpleChaincode) getLatestOrderStatus(stub shim.ChaincodeStubInterface,
 		}
 		shipEventCode = shipObj.Attribute2
 		shipEvent = shipObj.Event
+		if len(shipObj.CurrentLocation) != 0 {
+			location = shipObj.CurrentLocation
+		}
+		if !shipObj.ExpectedDeliveryDate.IsZero() {
+			eta = getETAString(shipObj.ExpectedDeliveryDate)
+		}
 
 	}
 	//Check which is the latest of the statuses
@@ -1004,57 +1195,879 @@ func (t *SimpleChaincode) getLatestOrderStatus(stub shim.ChaincodeStubInterface,
 		eventCode = strconv.Itoa(pShipEventInt)
 	}
 
-	//Prepare appropriate response
-	var response string
-	if event == "Purchase Order Release" || event == "Order Received" || event == "Work Order Created" || event == "Purchase Order and Sales Order quantity matching" || event == "Work Order Created" {
-		response = "Your order " + orderID + " has been placed"
-	} else if event == "Work Order Complete" || event == "RoHs Compliance Certificate" || event == "Conflict Minerals Compliance" || event == "Final burn-in and Test Certificate" || event == "Country of Origin Certificate" {
-		response = "Your order " + orderID + " is getting ready to be shipped along with the requisite compliance certificates"
-	} else if event == "Shipment Executed" || event == "Invoice Generated" || event == "Invoice Documentation" {
-		response = "Shipment of your order " + orderID + " is just initiated."
-	} else if event == "Shipment En-route to Airport by Road – Started" {
-		response = "Your order " + orderID + " is en-route to airport by road."
-	} else if event == "Shipment En-route by Road - Arrived" {
-		response = "Your order " + orderID + " is getting ready for air-freight."
-	} else if event == "Shipment En-route by Air - Started" {
-		response = "Your order " + orderID + " is en-route by air."
-	} else if event == "Shipment En-route by Air - Arrived" {
-		response = "Your order " + orderID + " has arrived at destination airport."
-	} else if event == "Customs Clearance – Completed" {
-		response = "Your order " + orderID + " has cleared customs and is ready for transport to final destination."
-	} else if event == "Customs Clearance – Initiated" {
-		response = "Your order " + orderID + " has arrived at destination airport and is awaiting customs clearance."
-	} else if event == "Shipment En-route by Road - Started" {
-		response = "Your order " + orderID + " is near your location and is expected to be delivered shortly."
-	} else if event == "Shipment Reached Destination" || event == " Purchase Price Updated" {
-		response = "Your order " + orderID + " has reached destination."
-	} else if event == "Equipment Installation – In Progress" {
-		response = "Your order " + orderID + " has been delivered and installation is in progress."
-	} else if event == "Equipment Installation – Completed" {
-		response = "The installation of your order " + orderID + " has been completed."
-	} else if event == "Customer Accepted" {
-		response = "Customer has accepted the order " + orderID + "."
-	} else if event == " RoHs Compliance Certificate Verified" || event == "Conflict Minerals Compliance Verified" || event == "Final burn-in and Test Certificate Verified" {
-		response = "Customer has accepted the order " + orderID + ", and certificates are being verified."
-	} else if event == "Export Compliance Documentation" {
-		if eventCode == "70" {
-			response = "Shipment of your order " + orderID + " is just initiated."
-		} else if eventCode == "110" {
-			response = "Your order " + orderID + " is getting ready to be air-lifted along with the requisite documents."
-		} else if eventCode == "140" {
-			response = "Your order " + orderID + " has arrived at destination airport and documentation is in progress."
-		} else if eventCode == "170" {
-			response = "Your order " + orderID + " is getting ready to be transported by road with the requisite documents."
+	//Prepare appropriate response from the customer message of the event catalog in the locale
+	locale := ""
+	if len(args) > 1 {
+		locale = strings.TrimSpace(args[1])
+	}
+	if len(locale) == 0 {
+		locale, err = getPreferredLanguage(stub)
+		if err != nil {
+			return shim.Error("Error 14 " + err.Error())
+		}
+	}
+	response := "Customer has verified all certificates and accepted the order " + orderID + "."
+	eventResp := stub.InvokeChaincode("salestransactions", util.ToChaincodeArgs("getEventDefinition", event, eventCode, locale), "orderprocessing")
+	if eventResp.Status == shim.OK {
+		eventObj := &eventDefinition{}
+		err = json.Unmarshal(eventResp.Payload, eventObj)
+		if err != nil {
+			return shim.Error("Error 15 " + err.Error())
+		}
+		//Prefer the delivery date estimated from the lifecycle durations of the lane and shipper
+		etaObj, err := getEstimatedETA(stub, orderID)
+		if err != nil {
+			return shim.Error("Error 16 " + err.Error())
+		}
+		//and compare it with the expected delivery date of the order
+		etaRange := eta
+		etaStatus := "as scheduled"
+		if etaObj != nil && etaObj.Confidence != "None" {
+			eta = getETAString(etaObj.EstimatedDeliveryDate)
+			etaRange = getETAString(etaObj.EarliestDeliveryDate) + " - " + getETAString(etaObj.LatestDeliveryDate)
+			if len(etaObj.Status) != 0 {
+				etaStatus = strings.ToLower(etaObj.Status) + " against the expected delivery date " + getETAString(etaObj.ExpectedDeliveryDate)
+			}
+		}
+		if len(eta) == 0 {
+			eta = "not yet available"
+			etaRange = eta
+		}
+		if len(location) == 0 {
+			location = "the last reported location"
+		}
+		replacer := strings.NewReplacer("{orderID}", orderID, "{location}", location, "{eta}", eta, "{etaRange}", etaRange, "{etaStatus}", etaStatus)
+		response = replacer.Replace(eventObj.MessageTemplate)
+	}
+
+	return shim.Success([]byte(response))
+}
+
+func getETAString(eta time.Time) string {
+	if eta.IsZero() {
+		return ""
+	}
+	return eta.Format("2006-01-02")
+}
+
+//=========================================================================================
+//getOrderETA - Function to return the estimated delivery date of an order with its
+//confidence band, from the shipment of the order or else from the sales order
+//=========================================================================================
+func (t *SimpleChaincode) getOrderETA(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 1")
+	}
+	etaObj, err := getEstimatedETA(stub, args[0])
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if etaObj == nil {
+		return shim.Error("Order ID " + args[0] + " is invalid. The records for the order does not exist in the system.")
+	}
+	etaBytes, err := json.Marshal(etaObj)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	return shim.Success(etaBytes)
+}
+
+func getEstimatedETA(stub shim.ChaincodeStubInterface, orderID string) (*orderETA, error) {
+	etaResp := stub.InvokeChaincode("shippingtransactions", util.ToChaincodeArgs("getOrderETA", orderID), "shipping")
+	if etaResp.Status != shim.OK {
+		etaResp = stub.InvokeChaincode("salestransactions", util.ToChaincodeArgs("getOrderETA", orderID), "orderprocessing")
+	}
+	if etaResp.Status != shim.OK {
+		return nil, nil
+	}
+	etaObj := &orderETA{}
+	err := json.Unmarshal(etaResp.Payload, etaObj)
+	if err != nil {
+		return nil, err
+	}
+	return etaObj, nil
+}
+
+//=========================================================================================
+//getPreferredLanguage - Common Function to get the preferred language from the user profile
+//of the caller. The profile ID is read from a certificate attribute of the caller and the
+//profile with queryProfile of the user profile chaincode, by default the profileID
+//attribute and the userprofiles chaincode on the same channel (see setProfileSource).
+//Empty if the caller has no profile or the profile cannot be read
+//=========================================================================================
+func getPreferredLanguage(stub shim.ChaincodeStubInterface) (string, error) {
+	source, err := getProfileSource(stub)
+	if err != nil {
+		return "", err
+	}
+	profileID, found, err := cid.GetAttributeValue(stub, source.Attribute)
+	if err != nil {
+		return "", err
+	}
+	if !found || len(profileID) == 0 {
+		return "", nil
+	}
+	profileResp := stub.InvokeChaincode(source.Chaincode, util.ToChaincodeArgs("queryProfile", profileID), source.Channel)
+	if profileResp.Status != shim.OK {
+		return "", nil
+	}
+	profileObj := &userProfile{}
+	err = json.Unmarshal(profileResp.Payload, profileObj)
+	if err != nil {
+		return "", err
+	}
+	return profileObj.PreferredLanguage, nil
+}
+
+//=========================================================================================
+//getOrderGraph - Function to return the supply chain of an order as a graph of sales
+//orders, purchase orders, work orders and shipments linked by their relationship
+//Arguments: order ID, depth (levels of referencing orders to follow from the order)
+//=========================================================================================
+func (t *SimpleChaincode) getOrderGraph(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	orderID := args[0]
+	depth, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	if depth < 0 {
+		return shim.Error("Depth cannot be negative")
+	}
+	graph, err := buildOrderGraph(stub, orderID, depth)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if graph == nil {
+		return shim.Error("Order ID " + orderID + " is invalid. The records for the order does not exist in the system.")
+	}
+	graphBytes, err := json.Marshal(graph)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	return shim.Success(graphBytes)
+}
+
+//=========================================================================================
+//buildOrderGraph - Common Function to collect the orders, work orders and shipments related
+//to an order within the traversal limits, nil if the order does not exist
+//=========================================================================================
+func buildOrderGraph(stub shim.ChaincodeStubInterface, orderID string, depth int) (*orderGraph, error) {
+	limits, err := getTraversalLimits(stub)
+	if err != nil {
+		return nil, err
+	}
+	if depth > limits.MaxDepth {
+		depth = limits.MaxDepth
+	}
+	//The order is either a purchase order or a sales order
+	rootNode, found, err := getOrderNode(stub, "PO", orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		rootNode, found, err = getOrderNode(stub, "SO", orderID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+
+	graph := &orderGraph{orderID, depth, []graphNode{rootNode}, []graphEdge{}, []truncatedBranch{}, []string{}}
+	nodeIndex := map[string]bool{rootNode.NodeType + ":" + rootNode.ID: true}
+	var i int
+	for i = 0; i < len(graph.Nodes); i++ {
+		node := graph.Nodes[i]
+		if node.NodeType != "SO" && node.NodeType != "PO" {
+			continue
+		}
+		//Work order and shipment raised against the order
+		linkedNodes, err := getLinkedNodes(stub, node)
+		if err != nil {
+			return nil, err
+		}
+		if len(graph.Notes) == 0 && hasNodeType(linkedNodes, "WO") {
+			graph.Notes = append(graph.Notes, "Work orders are read with queryLatestStateByRef, only the latest work order raised against an order is included")
+		}
+		//Sales and purchase orders with the order as reference
+		childNodes, err := getChildOrderNodes(stub, node)
+		if err != nil {
+			return nil, err
+		}
+		if node.Level < depth {
+			linkedNodes = append(linkedNodes, childNodes...)
+		} else if len(childNodes) > 0 {
+			graph.Truncated = append(graph.Truncated, truncatedBranch{true, node.ID, node.NodeType, "maximum depth"})
+		}
+		var j int
+		for j = 0; j < len(linkedNodes); j++ {
+			if linkedNodes[j].ID == "" {
+				continue
+			}
+			relationship := "reference"
+			if linkedNodes[j].NodeType == "WO" {
+				relationship = "work-order"
+			} else if linkedNodes[j].NodeType == "Shipment" {
+				relationship = "shipment"
+			}
+			//A node reached again through a reference loop is linked but not expanded again
+			nodeKey := linkedNodes[j].NodeType + ":" + linkedNodes[j].ID
+			if nodeIndex[nodeKey] == true {
+				graph.Edges = append(graph.Edges, graphEdge{node.ID, linkedNodes[j].ID, relationship})
+				continue
+			}
+			if len(graph.Nodes) >= limits.MaxNodes {
+				graph.Truncated = append(graph.Truncated, truncatedBranch{true, linkedNodes[j].ID, linkedNodes[j].NodeType, "maximum node count"})
+				continue
+			}
+			graph.Edges = append(graph.Edges, graphEdge{node.ID, linkedNodes[j].ID, relationship})
+			nodeIndex[nodeKey] = true
+			linkedNodes[j].Level = node.Level + 1
+			graph.Nodes = append(graph.Nodes, linkedNodes[j])
+		}
+	}
+	return graph, nil
+}
+
+//=========================================================================================
+//getOrderNode - Common Function to get the latest state of a sales or purchase order
+//as a graph node
+//=========================================================================================
+func getOrderNode(stub shim.ChaincodeStubInterface, nodeType string, orderID string) (graphNode, bool, error) {
+	chaincode := "salestransactions"
+	if nodeType == "PO" {
+		chaincode = "purchaseordertransactions"
+	}
+	resp := stub.InvokeChaincode(chaincode, util.ToChaincodeArgs("queryOrder", orderID), "orderprocessing")
+	if resp.Status != shim.OK || len(resp.Payload) == 0 {
+		return graphNode{}, false, nil
+	}
+	node := graphNode{orderID, nodeType, "", "", chaincode, "orderprocessing", 0, resp.Payload}
+	if nodeType == "PO" {
+		poObj := &PurchaseOrder{}
+		err := json.Unmarshal(resp.Payload, poObj)
+		if err != nil {
+			return graphNode{}, false, err
+		}
+		node.Event = poObj.Event
+		node.EventCode = poObj.EventCode
+	} else {
+		soObj := &order{}
+		err := json.Unmarshal(resp.Payload, soObj)
+		if err != nil {
+			return graphNode{}, false, err
+		}
+		node.Event = soObj.Event
+		node.EventCode = soObj.Attribute2
+	}
+	return node, true, nil
+}
+
+//=========================================================================================
+//getChildOrderNodes - Common Function to get the sales and purchase orders that have
+//the order as reference
+//=========================================================================================
+func getChildOrderNodes(stub shim.ChaincodeStubInterface, node graphNode) ([]graphNode, error) {
+	childNodes := []graphNode{}
+	childTypes := []string{"SO", "PO"}
+	var i int
+	for i = 0; i < len(childTypes); i++ {
+		chaincode := "salestransactions"
+		if childTypes[i] == "PO" {
+			chaincode = "purchaseordertransactions"
+		}
+		resp := stub.InvokeChaincode(chaincode, util.ToChaincodeArgs("queryAllChildOrders", node.ID), "orderprocessing")
+		if resp.Status != shim.OK || len(resp.Payload) == 0 {
+			continue
+		}
+		childOrders := strings.Split(string(resp.Payload), ",")
+		var j int
+		for j = 0; j < len(childOrders); j++ {
+			childID := strings.TrimSpace(childOrders[j])
+			if childID == "" || childID == node.ID {
+				continue
+			}
+			childNode, found, err := getOrderNode(stub, childTypes[i], childID)
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				//Referencing order without a readable state is still part of the chain
+				childNode = graphNode{childID, childTypes[i], "", "", chaincode, "orderprocessing", 0, nil}
+			}
+			childNodes = append(childNodes, childNode)
+		}
+	}
+	return childNodes, nil
+}
+
+//=========================================================================================
+//getLinkedNodes - Common Function to get the work order and the shipments raised against
+//the order. The work order chaincode only returns the latest work order for a reference,
+//all shipments are read from the order index of the shipping chaincode
+//=========================================================================================
+func getLinkedNodes(stub shim.ChaincodeStubInterface, node graphNode) ([]graphNode, error) {
+	linkedNodes := []graphNode{}
+	woResp := stub.InvokeChaincode("workordertransactions", util.ToChaincodeArgs("queryLatestStateByRef", node.ID), "spmanufacturing")
+	if woResp.Status == shim.OK && len(woResp.Payload) != 0 {
+		woObj := &WorkOrder{}
+		err := json.Unmarshal(woResp.Payload, woObj)
+		if err != nil {
+			return nil, err
+		}
+		woID := woObj.OrderNumber
+		if woID == "" {
+			woID = woObj.OrderID
+		}
+		linkedNodes = append(linkedNodes, graphNode{woID, "WO", woObj.Event, woObj.EventCode, "workordertransactions", "spmanufacturing", 0, woResp.Payload})
+	}
+	shipResp := stub.InvokeChaincode("shippingtransactions", util.ToChaincodeArgs("queryAllChildOrders", node.ID), "shipping")
+	if shipResp.Status != shim.OK || len(shipResp.Payload) == 0 {
+		return linkedNodes, nil
+	}
+	shipmentIDs := strings.Split(string(shipResp.Payload), ",")
+	var i int
+	for i = 0; i < len(shipmentIDs); i++ {
+		shipmentID := strings.TrimSpace(shipmentIDs[i])
+		if shipmentID == "" {
+			continue
+		}
+		orderResp := stub.InvokeChaincode("shippingtransactions", util.ToChaincodeArgs("queryOrder", shipmentID), "shipping")
+		if orderResp.Status != shim.OK || len(orderResp.Payload) == 0 {
+			continue
+		}
+		shipObj := &order{}
+		err := json.Unmarshal(orderResp.Payload, shipObj)
+		if err != nil {
+			return nil, err
+		}
+		linkedNodes = append(linkedNodes, graphNode{shipmentID, "Shipment", shipObj.Event, shipObj.Attribute2, "shippingtransactions", "shipping", 0, orderResp.Payload})
+	}
+	return linkedNodes, nil
+}
+
+//=========================================================================================
+//hasNodeType - Common Function to check if any of the nodes is of the node type
+//=========================================================================================
+func hasNodeType(nodes []graphNode, nodeType string) bool {
+	var i int
+	for i = 0; i < len(nodes); i++ {
+		if nodes[i].NodeType == nodeType {
+			return true
+		}
+	}
+	return false
+}
+
+//=========================================================================================
+//getOrderTimeline - Function to return the transaction history of an order and of all
+//related sales orders, purchase orders, work orders and shipments in chronological order
+//Arguments: order ID, sources (optional, comma separated SO, PO, WO, Shipment), event
+//categories of the event catalog (optional, comma separated)
+//=========================================================================================
+func (t *SimpleChaincode) getOrderTimeline(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments, expecting 1 to 3")
+	}
+	orderID := args[0]
+	sourceFilter := map[string]bool{}
+	categoryFilter := map[string]bool{}
+	if len(args) > 1 {
+		sourceFilter = getFilterSet(args[1])
+	}
+	if len(args) > 2 {
+		categoryFilter = getFilterSet(args[2])
+	}
+	limits, err := getTraversalLimits(stub)
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	graph, err := buildOrderGraph(stub, orderID, limits.MaxDepth)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if graph == nil {
+		return shim.Error("Order ID " + orderID + " is invalid. The records for the order does not exist in the system.")
+	}
+
+	timeline := []timelineEntry{}
+	categories := map[string]string{}
+	var i int
+	for i = 0; i < len(graph.Nodes); i++ {
+		node := graph.Nodes[i]
+		if len(sourceFilter) > 0 && sourceFilter[strings.ToLower(node.NodeType)] == false {
+			continue
+		}
+		entries, err := getNodeHistory(stub, node)
+		if err != nil {
+			return shim.Error("Error 3 " + err.Error())
+		}
+		var j int
+		for j = 0; j < len(entries); j++ {
+			categoryKey := entries[j].Event + "~" + entries[j].Code
+			category, found := categories[categoryKey]
+			if !found {
+				category = getEventCategory(stub, entries[j].Event, entries[j].Code)
+				categories[categoryKey] = category
+			}
+			entries[j].Category = category
+			if len(categoryFilter) > 0 && categoryFilter[strings.ToLower(category)] == false {
+				continue
+			}
+			timeline = append(timeline, entries[j])
+		}
+	}
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].Timestamp.Before(timeline[j].Timestamp)
+	})
+	timelineBytes, err := json.Marshal(timeline)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	return shim.Success(timelineBytes)
+}
+
+func getFilterSet(filter string) map[string]bool {
+	filterSet := map[string]bool{}
+	values := strings.Split(filter, ",")
+	var i int
+	for i = 0; i < len(values); i++ {
+		value := strings.ToLower(strings.TrimSpace(values[i]))
+		if len(value) != 0 {
+			filterSet[value] = true
+		}
+	}
+	return filterSet
+}
+
+//=========================================================================================
+//getNodeHistory - Common Function to get the transaction history of an order, work order
+//or shipment normalized to timeline entries, entries with a timestamp that cannot be parsed
+//are left out of the timeline
+//=========================================================================================
+func getNodeHistory(stub shim.ChaincodeStubInterface, node graphNode) ([]timelineEntry, error) {
+	entries := []timelineEntry{}
+	resp := stub.InvokeChaincode(node.Chaincode, util.ToChaincodeArgs("queryTrxHistory", node.ID), node.Channel)
+	if resp.Status != shim.OK || len(resp.Payload) == 0 {
+		return entries, nil
+	}
+	history := []historyEntry{}
+	err := json.Unmarshal(resp.Payload, &history)
+	if err != nil {
+		return nil, err
+	}
+	var i int
+	for i = 0; i < len(history); i++ {
+		timestamp, err := parseHistoryTimestamp(history[i].TimeStamp)
+		if err != nil {
+			continue
+		}
+		entry := timelineEntry{timestamp.UTC(), node.NodeType, node.ID, "", "", "", "", history[i].TxID}
+		if history[i].IsDelete == "true" || len(history[i].Value) == 0 || string(history[i].Value) == "null" {
+			entry.Event = "Deleted"
+		} else if node.NodeType == "PO" {
+			poObj := &PurchaseOrder{}
+			err = json.Unmarshal(history[i].Value, poObj)
+			if err != nil {
+				return nil, err
+			}
+			entry.Event = poObj.Event
+			entry.Code = poObj.EventCode
+			entry.Actor = getActor(poObj.Custody, poObj.Owner)
+		} else if node.NodeType == "WO" {
+			woObj := &WorkOrder{}
+			err = json.Unmarshal(history[i].Value, woObj)
+			if err != nil {
+				return nil, err
+			}
+			entry.Event = woObj.Event
+			entry.Code = woObj.EventCode
+			entry.Actor = getActor(woObj.Custody, woObj.Owner)
 		} else {
-			response = "Your order" + orderID + "has requisite documents"
+			soObj := &order{}
+			err = json.Unmarshal(history[i].Value, soObj)
+			if err != nil {
+				return nil, err
+			}
+			entry.Event = soObj.Event
+			entry.Code = soObj.Attribute2
+			entry.Actor = getActor(soObj.Custody, soObj.Owner)
 		}
-	} else if event == "Payment Terms Updated" {
-		response = "Your order " + orderID + "   had experienced 2 vibrations."
-	} else if strings.ToLower(event) == "order for replacement part approved" {
-		response = "Your order " + orderID + "   had experienced 3 vibrations."
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+//Timestamps of the history are written with time.Time.String(), the zone is numeric when
+//the zone of the peer has no abbreviation
+func parseHistoryTimestamp(value string) (time.Time, error) {
+	layouts := []string{"2006-01-02 15:04:05.999999999 -0700 MST", "2006-01-02 15:04:05.999999999 -0700 -0700", time.RFC3339Nano}
+	var err error
+	var i int
+	for i = 0; i < len(layouts); i++ {
+		var timestamp time.Time
+		timestamp, err = time.Parse(layouts[i], strings.TrimSpace(value))
+		if err == nil {
+			return timestamp, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+//The party holding custody performed the transaction, else the owner
+func getActor(custody string, owner string) string {
+	if len(custody) != 0 {
+		return custody
+	}
+	return owner
+}
+
+//Category of the event in the event catalog, empty if the event is not cataloged
+func getEventCategory(stub shim.ChaincodeStubInterface, event string, eventCode string) string {
+	eventResp := stub.InvokeChaincode("salestransactions", util.ToChaincodeArgs("getEventDefinition", event, eventCode), "orderprocessing")
+	if eventResp.Status != shim.OK {
+		return ""
+	}
+	eventObj := &eventDefinition{}
+	err := json.Unmarshal(eventResp.Payload, eventObj)
+	if err != nil {
+		return ""
+	}
+	return eventObj.Category
+}
+
+//=========================================================================================
+//traceLot - Function for the forward trace of a lot: the sales orders and shipments which
+//contain the lot, and the purchase orders and work orders raised for those sales orders.
+//The chaincodes that could not be queried are returned as incomplete sources
+//=========================================================================================
+func (t *SimpleChaincode) traceLot(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	lotNumber := strings.TrimSpace(args[0])
+	if len(lotNumber) == 0 {
+		return shim.Error("Lot number cannot be null")
+	}
+	trace := &lotTrace{lotNumber, []tracedOrder{}, []string{}}
+	traced := map[string]bool{}
+	sources := []graphNode{graphNode{"", "SO", "", "", "salestransactions", "orderprocessing", 0, nil}, graphNode{"", "Shipment", "", "", "shippingtransactions", "shipping", 0, nil}}
+	var i int
+	for i = 0; i < len(sources); i++ {
+		resp := stub.InvokeChaincode(sources[i].Chaincode, util.ToChaincodeArgs("queryByLot", lotNumber), sources[i].Channel)
+		if resp.Status != shim.OK {
+			//The lot is traced without shipments when the shipping ledger cannot be queried
+			if sources[i].NodeType == "Shipment" {
+				trace.IncompleteSources = append(trace.IncompleteSources, sources[i].Chaincode)
+				continue
+			}
+			return shim.Error("Error 1 " + resp.Message)
+		}
+		lotOrders := []order{}
+		err := json.Unmarshal(resp.Payload, &lotOrders)
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		var j int
+		for j = 0; j < len(lotOrders); j++ {
+			orderBytes, err := json.Marshal(lotOrders[j])
+			if err != nil {
+				return shim.Error("Error 3 " + err.Error())
+			}
+			node := graphNode{lotOrders[j].SalesOrderID, sources[i].NodeType, lotOrders[j].Event, lotOrders[j].Attribute2, sources[i].Chaincode, sources[i].Channel, 0, orderBytes}
+			relatedNodes := []graphNode{node}
+			if sources[i].NodeType == "SO" {
+				//Purchase orders of the sales order, and the work order and shipment raised for it
+				poIDs := []string{lotOrders[j].PONumber, lotOrders[j].Reference}
+				var k int
+				for k = 0; k < len(poIDs); k++ {
+					if len(poIDs[k]) == 0 {
+						continue
+					}
+					poNode, found, err := getOrderNode(stub, "PO", poIDs[k])
+					if err != nil {
+						return shim.Error("Error 4 " + err.Error())
+					}
+					if found {
+						relatedNodes = append(relatedNodes, poNode)
+					}
+				}
+				linkedNodes, err := getLinkedNodes(stub, node)
+				if err != nil {
+					return shim.Error("Error 5 " + err.Error())
+				}
+				relatedNodes = append(relatedNodes, linkedNodes...)
+			}
+			var k int
+			for k = 0; k < len(relatedNodes); k++ {
+				nodeKey := relatedNodes[k].NodeType + ":" + relatedNodes[k].ID
+				if relatedNodes[k].ID == "" || traced[nodeKey] == true {
+					continue
+				}
+				tracedObj, err := getTracedOrder(relatedNodes[k])
+				if err != nil {
+					return shim.Error("Error 6 " + err.Error())
+				}
+				traced[nodeKey] = true
+				trace.Orders = append(trace.Orders, tracedObj)
+			}
+		}
+	}
+	traceBytes, err := json.Marshal(trace)
+	if err != nil {
+		return shim.Error("Error 7 " + err.Error())
+	}
+	return shim.Success(traceBytes)
+}
+
+//=========================================================================================
+//traceOrderInputs - Function for the backward trace of an order: the lots and serial
+//numbers of the order and of the orders, work orders and shipments related to it
+//=========================================================================================
+func (t *SimpleChaincode) traceOrderInputs(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+	orderID := args[0]
+	limits, err := getTraversalLimits(stub)
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	graph, err := buildOrderGraph(stub, orderID, limits.MaxDepth)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if graph == nil {
+		return shim.Error("Order ID " + orderID + " is invalid. The records for the order does not exist in the system.")
+	}
+	trace := &inputTrace{orderID, []string{}, []string{}, []tracedOrder{}}
+	isListed := map[string]bool{}
+	var i int
+	for i = 0; i < len(graph.Nodes); i++ {
+		tracedObj, err := getTracedOrder(graph.Nodes[i])
+		if err != nil {
+			return shim.Error("Error 3 " + err.Error())
+		}
+		if len(tracedObj.LotNumber) == 0 && len(tracedObj.SerialNumber) == 0 {
+			continue
+		}
+		trace.Inputs = append(trace.Inputs, tracedObj)
+		lots := getTraceList(tracedObj.LotNumber)
+		var j int
+		for j = 0; j < len(lots); j++ {
+			if isListed["lot:"+lots[j]] == false {
+				isListed["lot:"+lots[j]] = true
+				trace.LotNumbers = append(trace.LotNumbers, lots[j])
+			}
+		}
+		serials := getTraceList(tracedObj.SerialNumber)
+		for j = 0; j < len(serials); j++ {
+			if isListed["serial:"+serials[j]] == false {
+				isListed["serial:"+serials[j]] = true
+				trace.SerialNumbers = append(trace.SerialNumbers, serials[j])
+			}
+		}
+	}
+	traceBytes, err := json.Marshal(trace)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	return shim.Success(traceBytes)
+}
+
+//=========================================================================================
+//getTracedOrder - Common Function to get the lot and serial numbers from the state of a
+//sales order, purchase order, work order or shipment
+//=========================================================================================
+func getTracedOrder(node graphNode) (tracedOrder, error) {
+	tracedObj := tracedOrder{node.ID, node.NodeType, node.Event, node.EventCode, node.Chaincode, node.Channel, "", ""}
+	if len(node.State) == 0 {
+		return tracedObj, nil
+	}
+	if node.NodeType == "PO" {
+		poObj := &PurchaseOrder{}
+		err := json.Unmarshal(node.State, poObj)
+		if err != nil {
+			return tracedObj, err
+		}
+		tracedObj.SerialNumber = poObj.SerialNo
+	} else if node.NodeType == "WO" {
+		woObj := &WorkOrder{}
+		err := json.Unmarshal(node.State, woObj)
+		if err != nil {
+			return tracedObj, err
+		}
+		tracedObj.SerialNumber = woObj.SerialNo
 	} else {
-		response = "Customer has verified all certificates and accepted the order " + orderID + "."
+		soObj := &order{}
+		err := json.Unmarshal(node.State, soObj)
+		if err != nil {
+			return tracedObj, err
+		}
+		tracedObj.LotNumber = soObj.LotNumber
+		tracedObj.SerialNumber = soObj.SerialNumber
 	}
+	return tracedObj, nil
+}
 
-	return shim.Success([]byte(response))
+//Lot and serial numbers of an order are comma separated
+func getTraceList(value string) []string {
+	values := []string{}
+	list := strings.Split(value, ",")
+	var i int
+	for i = 0; i < len(list); i++ {
+		if len(strings.TrimSpace(list[i])) != 0 {
+			values = append(values, strings.TrimSpace(list[i]))
+		}
+	}
+	return values
+}
+
+//=========================================================================================
+//setTraversalLimits - Function for an administrator to set the maximum depth and number
+//of orders followed when traversing the orders referencing an order
+//=========================================================================================
+func (t *SimpleChaincode) setTraversalLimits(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+	//Only administrators can change the traversal limits
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	maxDepth, err := strconv.Atoi(args[0])
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	maxNodes, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	if maxDepth < 0 || maxNodes < 1 {
+		return shim.Error("Maximum depth cannot be negative and maximum node count must be positive")
+	}
+	limitsBytes, err := json.Marshal(&traversalLimits{maxDepth, maxNodes})
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	err = stub.PutState("TraversalLimits", limitsBytes)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	return shim.Success(limitsBytes)
+}
+
+//=========================================================================================
+//setProfileSource - Function for an administrator to set where the preferred language of
+//the caller is read from
+//Arguments: user profile chaincode, channel (empty for the channel of this chaincode),
+//certificate attribute holding the profile ID
+//=========================================================================================
+func (t *SimpleChaincode) setProfileSource(stub shim.ChaincodeStubInterface, args []string) peer.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 3")
+	}
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	source := &profileSource{strings.TrimSpace(args[0]), strings.TrimSpace(args[1]), strings.TrimSpace(args[2])}
+	if len(source.Chaincode) == 0 || len(source.Attribute) == 0 {
+		return shim.Error("User profile chaincode and attribute cannot be null")
+	}
+	sourceBytes, err := json.Marshal(source)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	err = stub.PutState("ProfileSource", sourceBytes)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	return shim.Success(sourceBytes)
+}
+
+//Profiles are read from the userprofiles chaincode on the same channel with the profileID
+//attribute until the profile source is set
+func getProfileSource(stub shim.ChaincodeStubInterface) (profileSource, error) {
+	source := profileSource{"userprofiles", "", "profileID"}
+	sourceBytes, err := stub.GetState("ProfileSource")
+	if err != nil {
+		return source, err
+	}
+	if sourceBytes != nil {
+		err = json.Unmarshal(sourceBytes, &source)
+		if err != nil {
+			return source, err
+		}
+	}
+	return source, nil
+}
+
+//Traversal is limited to 10 levels and 100 orders until limits are set
+func getTraversalLimits(stub shim.ChaincodeStubInterface) (traversalLimits, error) {
+	limits := traversalLimits{10, 100}
+	limitsBytes, err := stub.GetState("TraversalLimits")
+	if err != nil {
+		return limits, err
+	}
+	if limitsBytes != nil {
+		err = json.Unmarshal(limitsBytes, &limits)
+		if err != nil {
+			return limits, err
+		}
+	}
+	return limits, nil
+}
+
+func newOrderTraversal(stub shim.ChaincodeStubInterface) (*orderTraversal, error) {
+	limits, err := getTraversalLimits(stub)
+	if err != nil {
+		return nil, err
+	}
+	return &orderTraversal{limits, map[string]bool{}, 0, []truncatedBranch{}}, nil
+}
+
+//=========================================================================================
+//getChildOrderList - Common Function to return the comma separated orders of a child order
+//query as a list, with the orders not followed listed separately as truncated
+//=========================================================================================
+func getChildOrderList(orderID string, resp peer.Response, traversal *orderTraversal) peer.Response {
+	if resp.Status != shim.OK {
+		return resp
+	}
+	listBytes, err := json.Marshal(&childOrderList{orderID, getTraceList(string(resp.Payload)), traversal.Truncated})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(listBytes)
+}
+
+//=========================================================================================
+//visitOrder - Common Function to mark an order visited by the traversal, returns the reason
+//the order is not to be followed when it was visited before or is beyond the limits
+//=========================================================================================
+func visitOrder(traversal *orderTraversal, orderType string, orderID string, depth int) string {
+	orderKey := orderType + ":" + orderID
+	if traversal.Visited[orderKey] == true {
+		return "already visited"
+	}
+	if depth > traversal.Limits.MaxDepth {
+		return "maximum depth"
+	}
+	if traversal.NodeCount >= traversal.Limits.MaxNodes {
+		return "maximum node count"
+	}
+	traversal.Visited[orderKey] = true
+	traversal.NodeCount = traversal.NodeCount + 1
+	return ""
+}
+
+func getTruncationMarker(orderType string, orderID string, reason string) []byte {
+	markerBytes, _ := json.Marshal([]truncatedBranch{truncatedBranch{true, orderID, orderType, reason}})
+	return markerBytes
 }
@@ -5,11 +5,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -68,6 +71,28 @@ type order struct {
 	InvalidTrx            string `json:"invalidTrx"`
 	//Adding additional counter for PTR Track and Trace App requirement
 	Count int `json:"count"`
+	//Compliance holds released through an approved override
+	ComplianceOverrides []complianceOverride `json:"complianceOverrides"`
+	//Transaction which placed the order on its current compliance hold
+	HoldTxID string `json:"holdTxID"`
+	//Notice of the last approved compliance override
+	OverrideNotice string `json:"overrideNotice"`
+}
+
+//Compliance override - request to release a compliance hold (InvalidTrx) on an order
+type complianceOverride struct {
+	ObjectType    string    `json:"objectType"`
+	OverrideID    string    `json:"overrideID"`
+	OrderID       string    `json:"orderID"`
+	CheckName     string    `json:"checkName"`
+	CheckCode     string    `json:"checkCode"`
+	Justification string    `json:"justification"`
+	RequestedBy   string    `json:"requestedBy"`
+	RequestDate   time.Time `json:"requestDate"`
+	Approvers     []string  `json:"approvers"`
+	ApprovalDate  time.Time `json:"approvalDate"`
+	Status        string    `json:"status"`
+	HoldTxID      string    `json:"holdTxID"`
 }
 
 type PurchaseOrder struct {
@@ -117,10 +142,139 @@ type OrderInfo struct {
 	OrderVal string
 }
 
+type eventDefinition struct {
+	ObjectType        string   `json:"objectType"`
+	EventName         string   `json:"eventName"`
+	StageCode         string   `json:"stageCode"`
+	Category          string   `json:"category"`
+	MessageTemplate   string   `json:"messageTemplate"`
+	AllowedChaincodes []string `json:"allowedChaincodes"`
+}
+
+type eventMessage struct {
+	ObjectType      string `json:"objectType"`
+	EventName       string `json:"eventName"`
+	StageCode       string `json:"stageCode"`
+	Locale          string `json:"locale"`
+	MessageTemplate string `json:"messageTemplate"`
+}
+
+//ETA clock - time at which an order first reached each event code
+type etaClock struct {
+	ObjectType string     `json:"objectType"`
+	OrderID    string     `json:"orderID"`
+	Stages     []etaStage `json:"stages"`
+	Delivered  bool       `json:"delivered"`
+}
+
+type etaStage struct {
+	Code string    `json:"code"`
+	Date time.Time `json:"date"`
+}
+
+//ETA sample - hours an order took between two event codes, one record per order so that
+//orders of the same lane do not update the same key
+type etaSample struct {
+	ObjectType  string  `json:"objectType"`
+	Origin      string  `json:"origin"`
+	Destination string  `json:"destination"`
+	FromCode    string  `json:"fromCode"`
+	ToCode      string  `json:"toCode"`
+	Shipper     string  `json:"shipper"`
+	OrderID     string  `json:"orderID"`
+	Hours       float64 `json:"hours"`
+}
+
+//ETA statistic - mean and variance of the hours elapsed between two event codes for a
+//lane (country of origin to destination) and shipper, computed from the samples
+type etaStatistic struct {
+	ObjectType  string  `json:"objectType"`
+	Origin      string  `json:"origin"`
+	Destination string  `json:"destination"`
+	Shipper     string  `json:"shipper"`
+	FromCode    string  `json:"fromCode"`
+	ToCode      string  `json:"toCode"`
+	Count       int     `json:"count"`
+	MeanHours   float64 `json:"meanHours"`
+	M2          float64 `json:"m2"`
+}
+
+//Serial registry - serial number commissioned by a manufacturer for an item, with the
+//orders it has belonged to
+type serialRecord struct {
+	ObjectType     string             `json:"objectType"`
+	Item           string             `json:"item"`
+	SerialNumber   string             `json:"serialNumber"`
+	Manufacturer   string             `json:"manufacturer"`
+	CommissionedBy string             `json:"commissionedBy"`
+	CommissionDate time.Time          `json:"commissionDate"`
+	CommissionTxID string             `json:"commissionTxID"`
+	Status         string             `json:"status"`
+	OrderID        string             `json:"orderID"`
+	Assignments    []serialAssignment `json:"assignments"`
+}
+
+type serialAssignment struct {
+	OrderID      string    `json:"orderID"`
+	Customer     string    `json:"customer"`
+	AssignedDate time.Time `json:"assignedDate"`
+	AssignTxID   string    `json:"assignTxID"`
+	ReleasedDate time.Time `json:"releasedDate"`
+	Reason       string    `json:"reason"`
+}
+
+type serialVerification struct {
+	Item           string             `json:"item"`
+	SerialNumber   string             `json:"serialNumber"`
+	Genuine        bool               `json:"genuine"`
+	Status         string             `json:"status"`
+	Warning        string             `json:"warning"`
+	Manufacturer   string             `json:"manufacturer"`
+	CommissionDate time.Time          `json:"commissionDate"`
+	CurrentOrderID string             `json:"currentOrderID"`
+	ClaimingOrders []string           `json:"claimingOrders"`
+	Provenance     []serialAssignment `json:"provenance"`
+}
+
+type orderChange struct {
+	TxID      string        `json:"txID"`
+	Timestamp time.Time     `json:"timestamp"`
+	Event     string        `json:"event"`
+	IsDelete  bool          `json:"isDelete"`
+	Changes   []fieldChange `json:"changes"`
+}
+
+type fieldChange struct {
+	Field    string          `json:"field"`
+	OldValue json.RawMessage `json:"oldValue"`
+	NewValue json.RawMessage `json:"newValue"`
+}
+
+type orderETA struct {
+	OrderID               string    `json:"orderID"`
+	Origin                string    `json:"origin"`
+	Destination           string    `json:"destination"`
+	Shipper               string    `json:"shipper"`
+	StageCode             string    `json:"stageCode"`
+	StageDate             time.Time `json:"stageDate"`
+	EstimatedDeliveryDate time.Time `json:"estimatedDeliveryDate"`
+	EarliestDeliveryDate  time.Time `json:"earliestDeliveryDate"`
+	LatestDeliveryDate    time.Time `json:"latestDeliveryDate"`
+	ExpectedDeliveryDate  time.Time `json:"expectedDeliveryDate"`
+	VarianceHours         float64   `json:"varianceHours"`
+	SampleCount           int       `json:"sampleCount"`
+	Confidence            string    `json:"confidence"`
+	Status                string    `json:"status"`
+}
+
 //========================
 //Initialize the chaincode
 //========================
 func (t *SimpleChainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	err := loadDefaultEventCatalog(stub)
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -155,6 +309,38 @@ func (t *SimpleChainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.getTrxCount(stub)
 	} else if function == "queryLatestStateByRef" {
 		return t.queryLatestStateByRef(stub, args)
+	} else if function == "requestComplianceOverride" {
+		return t.requestComplianceOverride(stub, args)
+	} else if function == "approveComplianceOverride" {
+		return t.approveComplianceOverride(stub, args)
+	} else if function == "queryComplianceOverrides" {
+		return t.queryComplianceOverrides(stub, args)
+	} else if function == "defineEvent" {
+		return t.defineEvent(stub, args)
+	} else if function == "queryEventCatalog" {
+		return t.queryEventCatalog(stub, args)
+	} else if function == "getEventDefinition" {
+		return t.getEventDefinition(stub, args)
+	} else if function == "defineEventMessage" {
+		return t.defineEventMessage(stub, args)
+	} else if function == "getOrderETA" {
+		return t.getOrderETA(stub, args)
+	} else if function == "queryByLot" {
+		return t.queryByTraceIndex(stub, "lotIndex", args)
+	} else if function == "queryBySerial" {
+		return t.queryByTraceIndex(stub, "serialIndex", args)
+	} else if function == "queryOrders" {
+		return t.queryOrders(stub, args)
+	} else if function == "queryOpenOrdersByParty" {
+		return t.queryOpenOrdersByParty(stub, args)
+	} else if function == "queryOrderChanges" {
+		return t.queryOrderChanges(stub, args)
+	} else if function == "commissionSerials" {
+		return t.commissionSerials(stub, args)
+	} else if function == "verifySerial" {
+		return t.verifySerial(stub, args)
+	} else if function == "reindexTraceNumbers" {
+		return t.reindexTraceNumbers(stub, args)
 	} else {
 		return shim.Error("Not a valid function " + function)
 	}
@@ -458,7 +644,12 @@ func (t *SimpleChainCode) createOrder(stub shim.ChaincodeStubInterface, args []s
 
 	//Create an order object
 	objectType := "sales order"
-	orderObj := &order{objectType, orderID, item, itemDesc, customer, manufacturer, shipper, supplier, quantity, event, expectedDeliveryDate, actualDeliveryDate, exception, documentType, attachment, workOrder, invoice, purchaseOrder, certification, reference, netAmount, unitPrice, charges, discount, tax, owner, custody, currentLoc, countryOfOrigin, destination, maxVib, temperature, notification, crossCountry, serialNum, lotNum, attr1, attr2, attr3, attr4, attr5, attr6, invalidTrx, count}
+	overrides := []complianceOverride{}
+	holdTxID := ""
+	if invalidTrx == "Y" {
+		holdTxID = stub.GetTxID()
+	}
+	orderObj := &order{objectType, orderID, item, itemDesc, customer, manufacturer, shipper, supplier, quantity, event, expectedDeliveryDate, actualDeliveryDate, exception, documentType, attachment, workOrder, invoice, purchaseOrder, certification, reference, netAmount, unitPrice, charges, discount, tax, owner, custody, currentLoc, countryOfOrigin, destination, maxVib, temperature, notification, crossCountry, serialNum, lotNum, attr1, attr2, attr3, attr4, attr5, attr6, invalidTrx, count, overrides, holdTxID, ""}
 
 	//Convert the order object to JSON object
 	orderBytes, err = json.Marshal(orderObj)
@@ -472,6 +663,25 @@ func (t *SimpleChainCode) createOrder(stub shim.ChaincodeStubInterface, args []s
 	if err != nil {
 		return shim.Error("Error 18 " + err.Error())
 	}
+	//Start the ETA clock of the order
+	err = recordETAStage(stub, orderObj)
+	if err != nil {
+		return shim.Error("Error 25 " + err.Error())
+	}
+	//Index the order by the lot and serial numbers it contains
+	err = updateTraceIndex(stub, "lotIndex", orderID, "", lotNum)
+	if err != nil {
+		return shim.Error("Error 26 " + err.Error())
+	}
+	err = updateTraceIndex(stub, "serialIndex", orderID, "", serialNum)
+	if err != nil {
+		return shim.Error("Error 27 " + err.Error())
+	}
+	//Serial numbers must be commissioned and cannot belong to another active order
+	err = assignSerials(stub, orderObj, "")
+	if err != nil {
+		return shim.Error("Error 28 " + err.Error())
+	}
 
 	/*
 		//PTR Track and Trace App - Increment the count of SO transactions
@@ -941,6 +1151,20 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 	if len(event) == 0 {
 		return shim.Error("Event name cannot be null")
 	}
+	//Check the event against the event catalog and derive the event code if not provided
+	eventDef, err := getCatalogEvent(stub, event, attr2)
+	if err != nil {
+		return shim.Error("Error 49 " + err.Error())
+	}
+	if eventDef != nil {
+		if !isChaincodeAllowed(eventDef, "salestransactions") {
+			return shim.Error("Event " + event + " cannot be recorded on sales orders")
+		}
+		if len(attr2) == 0 {
+			attr2 = eventDef.StageCode
+		}
+	}
+	requestedEvent := event
 	//Check if manufacturer and customer information is available
 	if len(customer) == 0 {
 		return shim.Error("Customer cannot be null")
@@ -1258,7 +1482,6 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 				certification = "Obtained"
 				attachment = compOrderObj.Attachment
 				notification = "Shipment is RoHs compliant"
-				attr2 = strconv.Itoa(240)
 				attr3 = "Shipment is RoHs compliant"
 				attr4 = "a"
 				//Check if high vibration event has occured for the order
@@ -1290,7 +1513,6 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 			} else {
 				event = "RoHs Compliance Certificate not verified"
 				notification = "RoHs Compliance Certificate missing, hold payment"
-				attr2 = strconv.Itoa(240)
 				attr3 = "RoHs Compliance Certificate missing, hold payment"
 				//Check if high vibration event has occured for the order
 				inspectOrderBytes, err := stub.GetState(orderID)
@@ -1360,7 +1582,6 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 
 					attr4 = "c"
 				}
-				attr2 = strconv.Itoa(250)
 				attr3 = "Shipment is Conflict Minerals compliant"
 				//Check if high vibration event has occured for the order
 				inspectOrderBytes, err := stub.GetState(orderID)
@@ -1390,7 +1611,6 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 			} else {
 				event = "Conflict Minerals Compliance Certificate not verified"
 				notification = "Conflict Minerals Compliance Certificate missing, hold payment"
-				attr2 = strconv.Itoa(250)
 				attr3 = "Conflict Minerals Compliance Certificate missing, hold payment"
 				rohsBytes, err := stub.GetState(orderID)
 				if err != nil {
@@ -1477,7 +1697,6 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 
 					attr4 = "f"
 				}
-				attr2 = strconv.Itoa(260)
 				attr3 = "Shipment is Final burn-in and Test compliant"
 				//Check if high vibration event has occured for the order
 				inspectOrderBytes, err := stub.GetState(orderID)
@@ -1521,7 +1740,6 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 				} else {
 					notification = "Final burn-in and Test Certificate missing, hold payment"
 				}
-				attr2 = strconv.Itoa(260)
 				attr3 = "Final burn-in and Test Certificate missing, hold payment"
 				//Check if high vibration event has occured for the order
 				inspectOrderBytes, err := stub.GetState(orderID)
@@ -1559,6 +1777,22 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 		notification = strings.Join(conc, " ")
 	}
 
+	//Events set by the compliance verification take their stage code from the event catalog
+	if event != requestedEvent {
+		attr2, err = getEventStageCode(stub, event)
+		if err != nil {
+			return shim.Error("Error 54 " + err.Error())
+		}
+	}
+	//The event and stage code written to the order must be cataloged for sales orders
+	eventDef, err = getCatalogEvent(stub, event, attr2)
+	if err != nil {
+		return shim.Error("Error 55 " + err.Error())
+	}
+	if eventDef != nil && !isChaincodeAllowed(eventDef, "salestransactions") {
+		return shim.Error("Event " + event + " cannot be recorded on sales orders")
+	}
+
 	//Get default information from Shipping Transactions chaincode
 	if event == "Export Compliance Documentation" && attr2 == "200" {
 		chaincodeName := "shippingtransactions"
@@ -1585,9 +1819,22 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 		attr6 = respObj.Attribute6
 	}
 
+	//A hold continues while the order stays on hold, otherwise this transaction raises a new hold
+	holdTxID := ""
+	if invalidTrx == "Y" {
+		if orderObject.InvalidTrx == "Y" {
+			holdTxID = orderObject.HoldTxID
+		} else {
+			holdTxID = stub.GetTxID()
+		}
+	}
+	//Honour the approved overrides of the current hold only
+	overrides := orderObject.ComplianceOverrides
+	attr6, invalidTrx = applyComplianceOverrides(overrides, attr6, invalidTrx, holdTxID)
+
 	//Update an order object
 	objectType := "sales order"
-	orderObj := &order{objectType, orderID, item, itemDesc, customer, manufacturer, shipper, supplier, quantity, event, expectedDeliveryDate, actualDeliveryDate, exception, documentType, attachment, workOrder, invoice, purchaseOrder, certification, reference, netAmount, unitPrice, charges, discount, tax, owner, custody, currentLoc, countryOfOrigin, destination, maxVib, temperature, notification, crossCountry, serialNum, lotNum, attr1, attr2, attr3, attr4, attr5, attr6, invalidTrx, count}
+	orderObj := &order{objectType, orderID, item, itemDesc, customer, manufacturer, shipper, supplier, quantity, event, expectedDeliveryDate, actualDeliveryDate, exception, documentType, attachment, workOrder, invoice, purchaseOrder, certification, reference, netAmount, unitPrice, charges, discount, tax, owner, custody, currentLoc, countryOfOrigin, destination, maxVib, temperature, notification, crossCountry, serialNum, lotNum, attr1, attr2, attr3, attr4, attr5, attr6, invalidTrx, count, overrides, holdTxID, orderObject.OverrideNotice}
 
 	//Convert the order object to JSON object
 	orderBytes, err = json.Marshal(orderObj)
@@ -1604,6 +1851,25 @@ func (t *SimpleChainCode) updateOrder(stub shim.ChaincodeStubInterface, args []s
 	if err != nil {
 		return shim.Error("Error 46 " + err.Error())
 	}
+	//Update the ETA clock and the lifecycle duration statistics of the lane and shipper
+	err = recordETAStage(stub, orderObj)
+	if err != nil {
+		return shim.Error("Error 50 " + err.Error())
+	}
+	//Move the order to the index entries of its new lot and serial numbers
+	err = updateTraceIndex(stub, "lotIndex", orderID, orderObject.LotNumber, lotNum)
+	if err != nil {
+		return shim.Error("Error 51 " + err.Error())
+	}
+	err = updateTraceIndex(stub, "serialIndex", orderID, orderObject.SerialNumber, serialNum)
+	if err != nil {
+		return shim.Error("Error 52 " + err.Error())
+	}
+	//Serial numbers added to the order must be commissioned and free, removed ones are released
+	err = assignSerials(stub, orderObj, orderObject.SerialNumber)
+	if err != nil {
+		return shim.Error("Error 53 " + err.Error())
+	}
 	//PTR Track and Trace App - Increment the count of SO transactions
 	//Check if the order belongs to PTR organizations - if yes, create/update the ledger where count of trx are maintained
 	if customer == "Get Well Hospital" || customer == "MedSupply Corp" {
@@ -1950,3 +2216,1560 @@ func (t *SimpleChainCode) queryLatestStateByRef(stub shim.ChaincodeStubInterface
 	return shim.Success(orderBytes)
 
 }
+
+//=========================================================================================================
+//requestComplianceOverride - Function for a compliance officer to request release of a compliance hold
+//=========================================================================================================
+func (t *SimpleChainCode) requestComplianceOverride(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 3")
+	}
+	orderID := args[0]
+	checkName := args[1]
+	justification := args[2]
+	if len(orderID) == 0 {
+		return shim.Error("Error 2 Order ID cannot be null")
+	}
+	if len(justification) == 0 {
+		return shim.Error("Error 3 Justification cannot be null")
+	}
+	checkCode := getComplianceCheckCode(checkName)
+	if checkCode == "" {
+		return shim.Error("Error 4 Compliance check " + checkName + " is not in the list of values")
+	}
+
+	//Only compliance officers can request an override
+	requestedBy, err := getComplianceOfficer(stub)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+
+	//Check if the order is on hold for the compliance check
+	orderBytes, err := stub.GetState(orderID)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	} else if orderBytes == nil {
+		return shim.Error("Error 7 Invalid Order ID " + orderID)
+	}
+	orderObject := order{}
+	err = json.Unmarshal(orderBytes, &orderObject)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	if orderObject.InvalidTrx != "Y" || !strings.Contains(orderObject.Attribute6, checkCode) {
+		return shim.Error("Error 9 Order " + orderID + " is not on hold for " + checkName)
+	}
+
+	//Use the transaction ID as override ID
+	overrideID := stub.GetTxID()
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Error 10 " + err.Error())
+	}
+	requestDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	//The override is scoped to the hold the order is currently on
+	objectType := "compliance override"
+	overrideObj := &complianceOverride{objectType, overrideID, orderID, checkName, checkCode, justification, requestedBy, requestDate, []string{}, time.Time{}, "Pending", orderObject.HoldTxID}
+	overrideBytes, err := json.Marshal(overrideObj)
+	if err != nil {
+		return shim.Error("Error 11 " + err.Error())
+	}
+	overrideKey, err := stub.CreateCompositeKey("complianceOverride", []string{orderID, overrideID})
+	if err != nil {
+		return shim.Error("Error 12 " + err.Error())
+	}
+	err = stub.PutState(overrideKey, overrideBytes)
+	if err != nil {
+		return shim.Error("Error 13 " + err.Error())
+	}
+	err = stub.SetEvent("Compliance Override Requested", overrideBytes)
+	if err != nil {
+		return shim.Error("Error 14 " + err.Error())
+	}
+	return shim.Success(overrideBytes)
+}
+
+//=====================================================================================================
+//approveComplianceOverride - Function to approve an override; the hold is released on second approval
+//=====================================================================================================
+func (t *SimpleChainCode) approveComplianceOverride(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 2")
+	}
+	orderID := args[0]
+	overrideID := args[1]
+
+	//Only compliance officers can approve an override
+	approver, err := getComplianceOfficer(stub)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+
+	overrideKey, err := stub.CreateCompositeKey("complianceOverride", []string{orderID, overrideID})
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	overrideBytes, err := stub.GetState(overrideKey)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	} else if overrideBytes == nil {
+		return shim.Error("Error 5 Invalid Override ID " + overrideID)
+	}
+	overrideObj := complianceOverride{}
+	err = json.Unmarshal(overrideBytes, &overrideObj)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	if overrideObj.Status != "Pending" {
+		return shim.Error("Error 7 Override " + overrideID + " is already " + overrideObj.Status)
+	}
+
+	//Approvals need two distinct identities, neither of them being the requester
+	if approver == overrideObj.RequestedBy {
+		return shim.Error("Error 8 Override cannot be approved by the requester")
+	}
+	var i int
+	for i = 0; i < len(overrideObj.Approvers); i++ {
+		if overrideObj.Approvers[i] == approver {
+			return shim.Error("Error 9 Override has already been approved by this identity")
+		}
+	}
+	overrideObj.Approvers = append(overrideObj.Approvers, approver)
+
+	event := "Compliance Override Approval Recorded"
+	if len(overrideObj.Approvers) >= 2 {
+		txTimestamp, err := stub.GetTxTimestamp()
+		if err != nil {
+			return shim.Error("Error 10 " + err.Error())
+		}
+		overrideObj.ApprovalDate = time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+		overrideObj.Status = "Approved"
+		event = "Compliance Override Approved"
+
+		//Release the hold on the order and record the override against it
+		orderBytes, err := stub.GetState(orderID)
+		if err != nil {
+			return shim.Error("Error 11 " + err.Error())
+		} else if orderBytes == nil {
+			return shim.Error("Error 12 Invalid Order ID " + orderID)
+		}
+		orderObject := order{}
+		err = json.Unmarshal(orderBytes, &orderObject)
+		if err != nil {
+			return shim.Error("Error 13 " + err.Error())
+		}
+		if orderObject.InvalidTrx != "Y" || orderObject.HoldTxID != overrideObj.HoldTxID {
+			return shim.Error("Error 19 The hold of override " + overrideID + " is no longer in force")
+		}
+		orderObject.ComplianceOverrides = append(orderObject.ComplianceOverrides, overrideObj)
+		orderObject.Attribute6, orderObject.InvalidTrx = applyComplianceOverrides(orderObject.ComplianceOverrides, orderObject.Attribute6, orderObject.InvalidTrx, orderObject.HoldTxID)
+		orderObject.OverrideNotice = overrideObj.CheckName + " hold overridden: " + overrideObj.Justification
+		orderBytes, err = json.Marshal(orderObject)
+		if err != nil {
+			return shim.Error("Error 14 " + err.Error())
+		}
+		err = stub.PutState(orderID, orderBytes)
+		if err != nil {
+			return shim.Error("Error 15 " + err.Error())
+		}
+	}
+
+	overrideBytes, err = json.Marshal(overrideObj)
+	if err != nil {
+		return shim.Error("Error 16 " + err.Error())
+	}
+	err = stub.PutState(overrideKey, overrideBytes)
+	if err != nil {
+		return shim.Error("Error 17 " + err.Error())
+	}
+	err = stub.SetEvent(event, overrideBytes)
+	if err != nil {
+		return shim.Error("Error 18 " + err.Error())
+	}
+	return shim.Success(overrideBytes)
+}
+
+//=================================================================================
+//queryComplianceOverrides - Function to list all override requests for an order
+//=================================================================================
+func (t *SimpleChainCode) queryComplianceOverrides(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 1")
+	}
+	orderID := args[0]
+	overrideIterator, err := stub.GetStateByPartialCompositeKey("complianceOverride", []string{orderID})
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	defer overrideIterator.Close()
+
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("[")
+	for overrideIterator.HasNext() {
+		response, err := overrideIterator.Next()
+		if err != nil {
+			return shim.Error("Error 3 " + err.Error())
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Value)
+		isRecordWritten = true
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+//Map the compliance check name to the hold code used in attr6
+func getComplianceCheckCode(checkName string) string {
+	if checkName == "RoHs Compliance Certificate" {
+		return "b"
+	} else if checkName == "Conflict Minerals Compliance" {
+		return "c"
+	} else if checkName == "Final burn-in and Test Certificate" {
+		return "d"
+	} else if checkName == "Country of Origin Compliance" {
+		return "e"
+	}
+	return ""
+}
+
+//Return the identity of the invoking compliance officer as MSP ID and certificate ID
+func getComplianceOfficer(stub shim.ChaincodeStubInterface) (string, error) {
+	err := cid.AssertAttributeValue(stub, "role", "complianceOfficer")
+	if err != nil {
+		return "", fmt.Errorf("Caller is not an authorized compliance officer: %s", err.Error())
+	}
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "::" + id, nil
+}
+
+//Remove the hold codes released by approved overrides of the same hold from attr6 and clear the invalid flag if no holds remain
+func applyComplianceOverrides(overrides []complianceOverride, attr6 string, invalidTrx string, holdTxID string) (string, string) {
+	if invalidTrx != "Y" || attr6 == "a" {
+		return attr6, invalidTrx
+	}
+	var i int
+	for i = 0; i < len(overrides); i++ {
+		if overrides[i].Status == "Approved" && overrides[i].HoldTxID == holdTxID {
+			attr6 = strings.Replace(attr6, overrides[i].CheckCode, "", -1)
+		}
+	}
+	if attr6 == "" {
+		return "a", "N"
+	}
+	return attr6, invalidTrx
+}
+
+//=========================================================================================
+//defineEvent - Function for an administrator to add or change an event of the event catalog
+//Arguments: event name, stage code (empty for any stage), category, customer message
+//template ({orderID} is replaced by the order ID), allowed chaincodes (comma separated)
+//=========================================================================================
+func (t *SimpleChainCode) defineEvent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 5")
+	}
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 2 Caller is not an authorized administrator: " + err.Error())
+	}
+	eventName := strings.TrimSpace(args[0])
+	stageCode := strings.TrimSpace(args[1])
+	if len(eventName) == 0 {
+		return shim.Error("Event name cannot be null")
+	}
+	if len(stageCode) != 0 {
+		_, err := strconv.Atoi(stageCode)
+		if err != nil {
+			return shim.Error("Error 3 Stage code must be numeric " + err.Error())
+		}
+	}
+	allowedChaincodes := []string{}
+	chaincodeList := strings.Split(args[4], ",")
+	var i int
+	for i = 0; i < len(chaincodeList); i++ {
+		if len(strings.TrimSpace(chaincodeList[i])) != 0 {
+			allowedChaincodes = append(allowedChaincodes, strings.TrimSpace(chaincodeList[i]))
+		}
+	}
+	if len(allowedChaincodes) == 0 {
+		return shim.Error("At least one chaincode must be allowed to emit the event")
+	}
+	eventDef := &eventDefinition{"Event Definition", eventName, stageCode, args[2], args[3], allowedChaincodes}
+	err = putEventDefinition(stub, eventDef)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	eventBytes, err := json.Marshal(eventDef)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	return shim.Success(eventBytes)
+}
+
+//=========================================================================================
+//queryEventCatalog - Function to list the event catalog, optionally for an event name
+//=========================================================================================
+func (t *SimpleChainCode) queryEventCatalog(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	keys := []string{}
+	if len(args) > 0 && len(args[0]) != 0 {
+		keys = append(keys, getEventCatalogName(args[0]))
+	}
+	eventIterator, err := stub.GetStateByPartialCompositeKey("eventCatalog", keys)
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	defer eventIterator.Close()
+
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("[")
+	for eventIterator.HasNext() {
+		response, err := eventIterator.Next()
+		if err != nil {
+			return shim.Error("Error 2 " + err.Error())
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Value)
+		isRecordWritten = true
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+//=========================================================================================
+//getEventDefinition - Function to return the catalog entry of an event at a stage code
+//Arguments: event name, stage code, locale (optional, the customer message of the locale
+//replaces the default message when it is defined)
+//=========================================================================================
+func (t *SimpleChainCode) getEventDefinition(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 2 or 3")
+	}
+	eventDef, err := getCatalogEvent(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	if eventDef == nil {
+		return shim.Error("Event " + args[0] + " is not defined in the event catalog")
+	}
+	if len(args) == 3 && len(strings.TrimSpace(args[2])) != 0 {
+		messageTemplate, err := getLocalizedMessage(stub, eventDef, args[2])
+		if err != nil {
+			return shim.Error("Error 4 " + err.Error())
+		}
+		if len(messageTemplate) != 0 {
+			eventDef.MessageTemplate = messageTemplate
+		}
+	}
+	eventBytes, err := json.Marshal(eventDef)
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	return shim.Success(eventBytes)
+}
+
+//Event names are matched ignoring case and surrounding spaces
+func getEventCatalogName(eventName string) string {
+	return strings.ToLower(strings.TrimSpace(eventName))
+}
+
+//=========================================================================================
+//defineEventMessage - Function for an administrator to add or change the customer message
+//of a cataloged event in a locale
+//Arguments: event name, stage code (as cataloged, empty for any stage), locale (en, fr-CA),
+//customer message template ({orderID}, {location}, {eta}, {etaRange} and {etaStatus} are
+//replaced)
+//=========================================================================================
+func (t *SimpleChainCode) defineEventMessage(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 4")
+	}
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 2 Caller is not an authorized administrator: " + err.Error())
+	}
+	eventName := strings.TrimSpace(args[0])
+	stageCode := strings.TrimSpace(args[1])
+	locale := getLocaleName(args[2])
+	if len(eventName) == 0 || len(locale) == 0 {
+		return shim.Error("Event name and locale cannot be null")
+	}
+	if len(strings.TrimSpace(args[3])) == 0 {
+		return shim.Error("Customer message template cannot be null")
+	}
+	//The message can only be defined for an event stage of the catalog
+	eventKey, err := stub.CreateCompositeKey("eventCatalog", []string{getEventCatalogName(eventName), stageCode})
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	eventBytes, err := stub.GetState(eventKey)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	} else if eventBytes == nil {
+		return shim.Error("Event " + eventName + " with stage code " + stageCode + " is not defined in the event catalog")
+	}
+	messageObj := &eventMessage{"Event Message", eventName, stageCode, locale, args[3]}
+	messageBytes, err := json.Marshal(messageObj)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	messageKey, err := stub.CreateCompositeKey("eventMessage", []string{getEventCatalogName(eventName), stageCode, locale})
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	err = stub.PutState(messageKey, messageBytes)
+	if err != nil {
+		return shim.Error("Error 7 " + err.Error())
+	}
+	return shim.Success(messageBytes)
+}
+
+//Locales are matched ignoring case, fr_CA and fr-CA are the same locale
+func getLocaleName(locale string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(locale)), "_", "-", -1)
+}
+
+//=========================================================================================
+//getLocalizedMessage - Common Function to get the customer message of a catalog entry in a
+//locale, a regional locale (fr-CA) falls back to its language (fr), empty if not defined
+//=========================================================================================
+func getLocalizedMessage(stub shim.ChaincodeStubInterface, eventDef *eventDefinition, locale string) (string, error) {
+	locales := []string{getLocaleName(locale)}
+	if strings.Contains(locales[0], "-") {
+		locales = append(locales, strings.Split(locales[0], "-")[0])
+	}
+	var i int
+	for i = 0; i < len(locales); i++ {
+		messageKey, err := stub.CreateCompositeKey("eventMessage", []string{getEventCatalogName(eventDef.EventName), eventDef.StageCode, locales[i]})
+		if err != nil {
+			return "", err
+		}
+		messageBytes, err := stub.GetState(messageKey)
+		if err != nil {
+			return "", err
+		}
+		if messageBytes != nil {
+			messageObj := &eventMessage{}
+			err = json.Unmarshal(messageBytes, messageObj)
+			if err != nil {
+				return "", err
+			}
+			return messageObj.MessageTemplate, nil
+		}
+	}
+	return "", nil
+}
+
+func putEventDefinition(stub shim.ChaincodeStubInterface, eventDef *eventDefinition) error {
+	eventKey, err := stub.CreateCompositeKey("eventCatalog", []string{getEventCatalogName(eventDef.EventName), eventDef.StageCode})
+	if err != nil {
+		return err
+	}
+	eventBytes, err := json.Marshal(eventDef)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(eventKey, eventBytes)
+}
+
+//=========================================================================================
+//getCatalogEvent - Common Function to get the catalog entry of an event, the entry of the
+//stage code takes precedence over the entry for any stage, nil if the event is not cataloged
+//=========================================================================================
+func getCatalogEvent(stub shim.ChaincodeStubInterface, eventName string, stageCode string) (*eventDefinition, error) {
+	eventIterator, err := stub.GetStateByPartialCompositeKey("eventCatalog", []string{getEventCatalogName(eventName)})
+	if err != nil {
+		return nil, err
+	}
+	defer eventIterator.Close()
+	var anyStageDef *eventDefinition
+	isCataloged := false
+	for eventIterator.HasNext() {
+		response, err := eventIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		eventDef := &eventDefinition{}
+		err = json.Unmarshal(response.Value, eventDef)
+		if err != nil {
+			return nil, err
+		}
+		isCataloged = true
+		if eventDef.StageCode == strings.TrimSpace(stageCode) {
+			return eventDef, nil
+		}
+		if len(eventDef.StageCode) == 0 {
+			anyStageDef = eventDef
+		}
+	}
+	if isCataloged && anyStageDef == nil {
+		return nil, fmt.Errorf("Stage code %s is not defined for event %s", stageCode, eventName)
+	}
+	return anyStageDef, nil
+}
+
+func isChaincodeAllowed(eventDef *eventDefinition, chaincode string) bool {
+	var i int
+	for i = 0; i < len(eventDef.AllowedChaincodes); i++ {
+		if eventDef.AllowedChaincodes[i] == chaincode {
+			return true
+		}
+	}
+	return false
+}
+
+//=========================================================================================
+//loadDefaultEventCatalog - Common Function to add the events known to the order status
+//chatbot that are missing from the event catalog, entries already defined are kept.
+//Stage codes are those set by the order flow, other events are cataloged for any stage
+//=========================================================================================
+func loadDefaultEventCatalog(stub shim.ChaincodeStubInterface) error {
+	chaincodes := []string{"salestransactions", "purchaseordertransactions", "workordertransactions", "shippingtransactions"}
+	defaultEvents := [][]string{
+		{"Purchase Order Release", "", "order", "Your order {orderID} has been placed"},
+		{"Order Received", "", "order", "Your order {orderID} has been placed"},
+		{"Work Order Created", "", "manufacturing", "Your order {orderID} has been placed"},
+		{"Purchase Order and Sales Order quantity matching", "", "order", "Your order {orderID} has been placed"},
+		{"Work Order Complete", "", "manufacturing", "Your order {orderID} is getting ready to be shipped along with the requisite compliance certificates"},
+		{"RoHs Compliance Certificate", "", "compliance", "Your order {orderID} is getting ready to be shipped along with the requisite compliance certificates"},
+		{"Conflict Minerals Compliance", "", "compliance", "Your order {orderID} is getting ready to be shipped along with the requisite compliance certificates"},
+		{"Final burn-in and Test Certificate", "", "compliance", "Your order {orderID} is getting ready to be shipped along with the requisite compliance certificates"},
+		{"Country of Origin Certificate", "", "compliance", "Your order {orderID} is getting ready to be shipped along with the requisite compliance certificates"},
+		{"Shipment Executed", "", "shipment", "Shipment of your order {orderID} is just initiated."},
+		{"Invoice Generated", "", "invoice", "Shipment of your order {orderID} is just initiated."},
+		{"Invoice Documentation", "", "invoice", "Shipment of your order {orderID} is just initiated."},
+		{"Shipment En-route to Airport by Road – Started", "", "shipment", "Your order {orderID} is en-route to airport by road from {location}, the estimated delivery date is {eta} ({etaRange}), {etaStatus}."},
+		{"Shipment En-route by Road - Arrived", "", "shipment", "Your order {orderID} has arrived at {location} and is getting ready for air-freight, the estimated delivery date is {eta} ({etaRange}), {etaStatus}."},
+		{"Shipment En-route by Air - Started", "", "shipment", "Your order {orderID} is en-route by air from {location}, the estimated delivery date is {eta} ({etaRange}), {etaStatus}."},
+		{"Shipment En-route by Air - Arrived", "", "shipment", "Your order {orderID} has arrived at destination airport {location}, the estimated delivery date is {eta} ({etaRange}), {etaStatus}."},
+		{"Customs Clearance – Completed", "", "customs", "Your order {orderID} has cleared customs at {location} and is ready for transport to final destination, the estimated delivery date is {eta} ({etaRange}), {etaStatus}."},
+		{"Customs Clearance – Initiated", "", "customs", "Your order {orderID} has arrived at destination airport {location} and is awaiting customs clearance, the estimated delivery date is {eta} ({etaRange}), {etaStatus}."},
+		{"Shipment En-route by Road - Started", "", "shipment", "Your order {orderID} is near your location and is expected to be delivered shortly, the estimated delivery date is {eta} ({etaRange}), {etaStatus}."},
+		{"Shipment Reached Destination", "", "shipment", "Your order {orderID} has reached destination."},
+		{"Purchase Price Updated", "", "order", "Your order {orderID} has reached destination."},
+		{"Equipment Installation – In Progress", "", "installation", "Your order {orderID} has been delivered and installation is in progress."},
+		{"Equipment Installation – Completed", "", "installation", "The installation of your order {orderID} has been completed."},
+		{"Customer Accepted", "", "acceptance", "Customer has accepted the order {orderID}."},
+		{"RoHs Compliance Certificate Verified", "240", "acceptance", "Customer has accepted the order {orderID}, and certificates are being verified."},
+		{"RoHs Compliance Certificate not verified", "240", "acceptance", "Customer has accepted the order {orderID}, and certificates are being verified."},
+		{"Conflict Minerals Compliance Certificate Verified", "250", "acceptance", "Customer has accepted the order {orderID}, and certificates are being verified."},
+		{"Conflict Minerals Compliance Certificate not verified", "250", "acceptance", "Customer has accepted the order {orderID}, and certificates are being verified."},
+		{"Final burn-in and Test Certificate Verified", "260", "acceptance", "Customer has accepted the order {orderID}, and certificates are being verified."},
+		{"Final burn-in and Test Certificate not verified", "260", "acceptance", "Customer has accepted the order {orderID}, and certificates are being verified."},
+		{"Export Compliance Documentation", "70", "documentation", "Shipment of your order {orderID} is just initiated."},
+		{"Export Compliance Documentation", "110", "documentation", "Your order {orderID} is getting ready to be air-lifted along with the requisite documents."},
+		{"Export Compliance Documentation", "140", "documentation", "Your order {orderID} has arrived at destination airport and documentation is in progress."},
+		{"Export Compliance Documentation", "170", "documentation", "Your order {orderID} is getting ready to be transported by road with the requisite documents."},
+		{"Export Compliance Documentation", "200", "documentation", "Your order {orderID} has requisite documents"},
+		{"Export Compliance Documentation", "", "documentation", "Your order {orderID} has requisite documents"},
+		{"Payment Terms Updated", "", "exception", "Your order {orderID} had experienced 2 vibrations."},
+		{"Order for Replacement Part Approved", "", "exception", "Your order {orderID} had experienced 3 vibrations."},
+	}
+	var i int
+	for i = 0; i < len(defaultEvents); i++ {
+		eventKey, err := stub.CreateCompositeKey("eventCatalog", []string{getEventCatalogName(defaultEvents[i][0]), defaultEvents[i][1]})
+		if err != nil {
+			return err
+		}
+		eventBytes, err := stub.GetState(eventKey)
+		if err != nil {
+			return err
+		} else if eventBytes != nil {
+			continue
+		}
+		eventDef := &eventDefinition{"Event Definition", defaultEvents[i][0], defaultEvents[i][1], defaultEvents[i][2], defaultEvents[i][3], chaincodes}
+		err = putEventDefinition(stub, eventDef)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Return the stage code of an event, events of the compliance verification that are not
+//cataloged, e.g. the catalog was not loaded when the chaincode was upgraded, keep the stage
+//codes they had before the event catalog
+func getEventStageCode(stub shim.ChaincodeStubInterface, eventName string) (string, error) {
+	eventIterator, err := stub.GetStateByPartialCompositeKey("eventCatalog", []string{getEventCatalogName(eventName)})
+	if err != nil {
+		return "", err
+	}
+	defer eventIterator.Close()
+	for eventIterator.HasNext() {
+		response, err := eventIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		eventDef := &eventDefinition{}
+		err = json.Unmarshal(response.Value, eventDef)
+		if err != nil {
+			return "", err
+		}
+		if len(eventDef.StageCode) != 0 {
+			return eventDef.StageCode, nil
+		}
+	}
+	complianceStageCodes := map[string]string{
+		"RoHs Compliance Certificate Verified":                  "240",
+		"RoHs Compliance Certificate not verified":              "240",
+		"Conflict Minerals Compliance Certificate Verified":     "250",
+		"Conflict Minerals Compliance Certificate not verified": "250",
+		"Final burn-in and Test Certificate Verified":           "260",
+		"Final burn-in and Test Certificate not verified":       "260",
+	}
+	stageCode, isComplianceEvent := complianceStageCodes[eventName]
+	if isComplianceEvent == true {
+		return stageCode, nil
+	}
+	return "", fmt.Errorf("No stage code is defined for event %s in the event catalog", eventName)
+}
+
+//=========================================================================================
+//getOrderETA - Function to estimate the delivery date of an order from the durations of
+//delivered orders of the same lane and shipper, with a 95% confidence band
+//=========================================================================================
+func (t *SimpleChainCode) getOrderETA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 1")
+	}
+	orderID := args[0]
+	orderBytes, err := stub.GetState(orderID)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	} else if orderBytes == nil {
+		return shim.Error("Error 3 Invalid Order ID " + orderID)
+	}
+	orderObj := order{}
+	err = json.Unmarshal(orderBytes, &orderObj)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	clock, err := getETAClock(stub, orderID)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	etaObj := orderETA{}
+	etaObj.OrderID = orderID
+	etaObj.Origin = orderObj.CountryOfOrigin
+	etaObj.Destination = orderObj.Destination
+	etaObj.Shipper = orderObj.Shipper
+	etaObj.StageCode = orderObj.Attribute2
+	etaObj.ExpectedDeliveryDate = orderObj.ExpectedDeliveryDate
+	etaObj.EstimatedDeliveryDate = orderObj.ExpectedDeliveryDate
+	etaObj.EarliestDeliveryDate = orderObj.ExpectedDeliveryDate
+	etaObj.LatestDeliveryDate = orderObj.ExpectedDeliveryDate
+	etaObj.Confidence = "None"
+	var i int
+	for i = 0; i < len(clock.Stages); i++ {
+		if clock.Stages[i].Code == orderObj.Attribute2 {
+			etaObj.StageDate = clock.Stages[i].Date
+		}
+	}
+
+	if !orderObj.ActualDeliveryDate.IsZero() {
+		//Delivered orders report the actual delivery date
+		etaObj.EstimatedDeliveryDate = orderObj.ActualDeliveryDate
+		etaObj.EarliestDeliveryDate = orderObj.ActualDeliveryDate
+		etaObj.LatestDeliveryDate = orderObj.ActualDeliveryDate
+		etaObj.Confidence = "Actual"
+	} else if !etaObj.StageDate.IsZero() {
+		//Use the statistics of the shipper on the lane, or of all shippers on the lane
+		stat, err := getETAStatistic(stub, orderObj.CountryOfOrigin, orderObj.Destination, orderObj.Shipper, orderObj.Attribute2, "Delivered")
+		if err != nil {
+			return shim.Error("Error 6 " + err.Error())
+		}
+		if stat.Count == 0 {
+			stat, err = getETAStatistic(stub, orderObj.CountryOfOrigin, orderObj.Destination, "*", orderObj.Attribute2, "Delivered")
+			if err != nil {
+				return shim.Error("Error 7 " + err.Error())
+			}
+		}
+		if stat.Count > 0 {
+			band := 0.0
+			if stat.Count > 1 {
+				band = 1.96 * math.Sqrt(stat.M2/float64(stat.Count-1))
+			}
+			etaObj.EstimatedDeliveryDate = getHoursAfter(etaObj.StageDate, stat.MeanHours)
+			etaObj.EarliestDeliveryDate = getHoursAfter(etaObj.StageDate, math.Max(stat.MeanHours-band, 0))
+			etaObj.LatestDeliveryDate = getHoursAfter(etaObj.StageDate, stat.MeanHours+band)
+			etaObj.SampleCount = stat.Count
+			if stat.Count >= 30 {
+				etaObj.Confidence = "High"
+			} else if stat.Count >= 5 {
+				etaObj.Confidence = "Medium"
+			} else {
+				etaObj.Confidence = "Low"
+			}
+		}
+	}
+
+	//Compare the estimate with the expected delivery date
+	if !orderObj.ExpectedDeliveryDate.IsZero() {
+		etaObj.VarianceHours = etaObj.EstimatedDeliveryDate.Sub(orderObj.ExpectedDeliveryDate).Hours()
+		if etaObj.EarliestDeliveryDate.After(orderObj.ExpectedDeliveryDate) {
+			etaObj.Status = "Late"
+		} else if etaObj.EstimatedDeliveryDate.After(orderObj.ExpectedDeliveryDate) || etaObj.LatestDeliveryDate.After(orderObj.ExpectedDeliveryDate) {
+			etaObj.Status = "At Risk"
+		} else {
+			etaObj.Status = "On Time"
+		}
+	}
+	etaBytes, err := json.Marshal(etaObj)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	return shim.Success(etaBytes)
+}
+
+func getHoursAfter(date time.Time, hours float64) time.Time {
+	return date.Add(time.Duration(hours * float64(time.Hour)))
+}
+
+func getETAClock(stub shim.ChaincodeStubInterface, orderID string) (*etaClock, error) {
+	clockKey, err := stub.CreateCompositeKey("etaClock", []string{orderID})
+	if err != nil {
+		return nil, err
+	}
+	clockBytes, err := stub.GetState(clockKey)
+	if err != nil {
+		return nil, err
+	}
+	clock := &etaClock{"ETA Clock", orderID, []etaStage{}, false}
+	if clockBytes != nil {
+		err = json.Unmarshal(clockBytes, clock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return clock, nil
+}
+
+//=========================================================================================
+//getETAStatistic - Common Function to compute the statistic of the samples of a shipper
+//on the lane, or of all shippers on the lane ("*"), using Welford's running variance
+//=========================================================================================
+func getETAStatistic(stub shim.ChaincodeStubInterface, origin string, destination string, shipper string, fromCode string, toCode string) (*etaStatistic, error) {
+	keys := []string{origin, destination, fromCode, toCode}
+	if shipper != "*" {
+		keys = append(keys, shipper)
+	}
+	sampleIterator, err := stub.GetStateByPartialCompositeKey("etaSample", keys)
+	if err != nil {
+		return nil, err
+	}
+	defer sampleIterator.Close()
+	stat := &etaStatistic{"ETA Statistic", origin, destination, shipper, fromCode, toCode, 0, 0, 0}
+	for sampleIterator.HasNext() {
+		response, err := sampleIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		sample := etaSample{}
+		err = json.Unmarshal(response.Value, &sample)
+		if err != nil {
+			return nil, err
+		}
+		stat.Count = stat.Count + 1
+		delta := sample.Hours - stat.MeanHours
+		stat.MeanHours = stat.MeanHours + delta/float64(stat.Count)
+		stat.M2 = stat.M2 + delta*(sample.Hours-stat.MeanHours)
+	}
+	return stat, nil
+}
+
+//Record the hours an order took between two event codes as a sample of its lane and shipper
+func addETASample(stub shim.ChaincodeStubInterface, orderObj *order, fromCode string, toCode string, hours float64) error {
+	sample := &etaSample{"ETA Sample", orderObj.CountryOfOrigin, orderObj.Destination, fromCode, toCode, orderObj.Shipper, orderObj.SalesOrderID, hours}
+	sampleKey, err := stub.CreateCompositeKey("etaSample", []string{sample.Origin, sample.Destination, fromCode, toCode, sample.Shipper, sample.OrderID})
+	if err != nil {
+		return err
+	}
+	sampleBytes, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(sampleKey, sampleBytes)
+}
+
+//=========================================================================================
+//recordETAStage - Common Function to record the first time an order reaches an event code,
+//the elapsed time from the previous code, and on delivery the time from each code to delivery
+//=========================================================================================
+func recordETAStage(stub shim.ChaincodeStubInterface, orderObj *order) error {
+	clock, err := getETAClock(stub, orderObj.SalesOrderID)
+	if err != nil {
+		return err
+	}
+	if clock.Delivered == true {
+		return nil
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	stageDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+
+	isStageRecorded := len(orderObj.Attribute2) == 0
+	var i int
+	for i = 0; i < len(clock.Stages); i++ {
+		if clock.Stages[i].Code == orderObj.Attribute2 {
+			isStageRecorded = true
+		}
+	}
+	if isStageRecorded == false {
+		if len(clock.Stages) > 0 {
+			previous := clock.Stages[len(clock.Stages)-1]
+			err = addETASample(stub, orderObj, previous.Code, orderObj.Attribute2, stageDate.Sub(previous.Date).Hours())
+			if err != nil {
+				return err
+			}
+		}
+		clock.Stages = append(clock.Stages, etaStage{orderObj.Attribute2, stageDate})
+	}
+
+	if !orderObj.ActualDeliveryDate.IsZero() {
+		for i = 0; i < len(clock.Stages); i++ {
+			hours := orderObj.ActualDeliveryDate.Sub(clock.Stages[i].Date).Hours()
+			if hours >= 0 {
+				err = addETASample(stub, orderObj, clock.Stages[i].Code, "Delivered", hours)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		clock.Delivered = true
+	}
+
+	clockKey, err := stub.CreateCompositeKey("etaClock", []string{orderObj.SalesOrderID})
+	if err != nil {
+		return err
+	}
+	clockBytes, err := json.Marshal(clock)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(clockKey, clockBytes)
+}
+
+//=========================================================================================
+//queryByTraceIndex - Function to return the latest state of the orders containing a lot
+//number (lotIndex) or a serial number (serialIndex)
+//=========================================================================================
+func (t *SimpleChainCode) queryByTraceIndex(stub shim.ChaincodeStubInterface, indexName string, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 1")
+	}
+	if len(strings.TrimSpace(args[0])) == 0 {
+		return shim.Error("Error 2 Lot or serial number cannot be null")
+	}
+	orderIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{strings.TrimSpace(args[0])})
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	defer orderIterator.Close()
+
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("[")
+	for orderIterator.HasNext() {
+		response, err := orderIterator.Next()
+		if err != nil {
+			return shim.Error("Error 4 " + err.Error())
+		}
+		_, returnKeys, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			return shim.Error("Error 5 " + err.Error())
+		}
+		orderBytes, err := stub.GetState(returnKeys[1])
+		if err != nil {
+			return shim.Error("Error 6 " + err.Error())
+		} else if orderBytes == nil {
+			continue
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(orderBytes)
+		isRecordWritten = true
+	}
+	buffer.WriteString("]")
+	return shim.Success(buffer.Bytes())
+}
+
+//Lot and serial numbers of an order are comma separated
+func splitTraceList(value string) []string {
+	values := []string{}
+	list := strings.Split(value, ",")
+	var i int
+	for i = 0; i < len(list); i++ {
+		if len(strings.TrimSpace(list[i])) != 0 {
+			values = append(values, strings.TrimSpace(list[i]))
+		}
+	}
+	return values
+}
+
+//=========================================================================================
+//updateTraceIndex - Common Function to replace the lot or serial index entries of an order
+//for the old value by the entries for the new value. Orders written before the indexes
+//existed are indexed with reindexTraceNumbers
+//=========================================================================================
+func updateTraceIndex(stub shim.ChaincodeStubInterface, indexName string, orderID string, oldValue string, newValue string) error {
+	if oldValue == newValue {
+		return nil
+	}
+	oldValues := splitTraceList(oldValue)
+	var i int
+	for i = 0; i < len(oldValues); i++ {
+		indexKey, err := stub.CreateCompositeKey(indexName, []string{oldValues[i], orderID})
+		if err != nil {
+			return err
+		}
+		err = stub.DelState(indexKey)
+		if err != nil {
+			return err
+		}
+	}
+	newValues := splitTraceList(newValue)
+	for i = 0; i < len(newValues); i++ {
+		indexKey, err := stub.CreateCompositeKey(indexName, []string{newValues[i], orderID})
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(indexKey, []byte{0X00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//=========================================================================================
+//reindexTraceNumbers - Function for an administrator to index the lot and serial numbers of
+//the existing orders, a page of orders is indexed per transaction
+//Arguments: order ID to start from (empty for the first order), page size
+//Returns the number of orders indexed and the order ID to start the next page from, empty
+//when all orders are indexed
+//=========================================================================================
+func (t *SimpleChainCode) reindexTraceNumbers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 2")
+	}
+	err := cid.AssertAttributeValue(stub, "role", "administrator")
+	if err != nil {
+		return shim.Error("Error 2 Caller is not an authorized administrator: " + err.Error())
+	}
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil || pageSize < 1 {
+		return shim.Error("Error 3 Page size must be a positive number")
+	}
+	//Composite keys are not returned by range queries, only the orders and other plain keys
+	orderIterator, err := stub.GetStateByRange(args[0], "")
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	defer orderIterator.Close()
+	indexedCount := 0
+	nextKey := ""
+	var i int
+	for i = 0; orderIterator.HasNext(); i++ {
+		response, err := orderIterator.Next()
+		if err != nil {
+			return shim.Error("Error 5 " + err.Error())
+		}
+		if i == pageSize {
+			nextKey = response.Key
+			break
+		}
+		orderObj := order{}
+		err = json.Unmarshal(response.Value, &orderObj)
+		if err != nil || orderObj.ObjectType != "sales order" {
+			continue
+		}
+		err = updateTraceIndex(stub, "lotIndex", response.Key, "", orderObj.LotNumber)
+		if err != nil {
+			return shim.Error("Error 6 " + err.Error())
+		}
+		err = updateTraceIndex(stub, "serialIndex", response.Key, "", orderObj.SerialNumber)
+		if err != nil {
+			return shim.Error("Error 7 " + err.Error())
+		}
+		indexedCount = indexedCount + 1
+	}
+	resultBytes, err := json.Marshal(map[string]interface{}{"indexedCount": indexedCount, "nextKey": nextKey})
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	return shim.Success(resultBytes)
+}
+
+//=========================================================================================
+//commissionSerials - Function for a manufacturer to commission serial numbers of an item,
+//the manufacturer must be the manufacturer attribute or the MSP ID of the caller
+//Arguments: item, manufacturer, serial numbers (comma separated)
+//       or: item, manufacturer, prefix, first number, count (e.g. SN-, 0001, 500)
+//=========================================================================================
+func (t *SimpleChainCode) commissionSerials(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 5 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 3 or 5")
+	}
+	item := strings.TrimSpace(args[0])
+	manufacturer := strings.TrimSpace(args[1])
+	if len(item) == 0 || len(manufacturer) == 0 {
+		return shim.Error("Error 2 Item and manufacturer cannot be null")
+	}
+	err := cid.AssertAttributeValue(stub, "role", "manufacturer")
+	if err != nil {
+		return shim.Error("Error 3 Caller is not an authorized manufacturer: " + err.Error())
+	}
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return shim.Error("Error 4 " + err.Error())
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return shim.Error("Error 5 " + err.Error())
+	}
+	//The manufacturer is the manufacturer attribute of the caller, or its organization
+	callerManufacturer, found, err := cid.GetAttributeValue(stub, "manufacturer")
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	if !found {
+		callerManufacturer = mspID
+	}
+	if manufacturer != callerManufacturer {
+		return shim.Error("Caller can only commission serial numbers for manufacturer " + callerManufacturer)
+	}
+
+	serials := []string{}
+	if len(args) == 3 {
+		serials = splitTraceList(args[2])
+	} else {
+		first, err := strconv.Atoi(args[3])
+		if err != nil {
+			return shim.Error("Error 7 " + err.Error())
+		}
+		count, err := strconv.Atoi(args[4])
+		if err != nil {
+			return shim.Error("Error 8 " + err.Error())
+		}
+		if first < 0 || count <= 0 || count > 10000 {
+			return shim.Error("Error 9 First number cannot be negative and count must be between 1 and 10000")
+		}
+		//Keep the zero padding of the first number
+		numberFormat := "%0" + strconv.Itoa(len(strings.TrimSpace(args[3]))) + "d"
+		var i int
+		for i = 0; i < count; i++ {
+			serials = append(serials, args[2]+fmt.Sprintf(numberFormat, first+i))
+		}
+	}
+	if len(serials) == 0 {
+		return shim.Error("Error 10 At least one serial number must be commissioned")
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error("Error 11 " + err.Error())
+	}
+	commissionDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+	//Serial numbers written in this transaction are not returned by GetState, duplicates of the
+	//list are checked separately
+	isCommissioned := map[string]bool{}
+	var i int
+	for i = 0; i < len(serials); i++ {
+		serialObj, err := getSerialRecord(stub, item, serials[i])
+		if err != nil {
+			return shim.Error("Error 12 " + err.Error())
+		}
+		if serialObj != nil || isCommissioned[serials[i]] == true {
+			return shim.Error("Error 13 Serial number " + serials[i] + " is already commissioned for item " + item)
+		}
+		isCommissioned[serials[i]] = true
+		serialObj = &serialRecord{"Serial Number", item, serials[i], manufacturer, mspID + "::" + id, commissionDate, stub.GetTxID(), "Commissioned", "", []serialAssignment{}}
+		err = putSerialRecord(stub, serialObj)
+		if err != nil {
+			return shim.Error("Error 14 " + err.Error())
+		}
+	}
+	return shim.Success([]byte(strconv.Itoa(len(serials)) + " serial numbers commissioned for item " + item))
+}
+
+//=========================================================================================
+//verifySerial - Function to verify that a serial number of an item is genuine and return
+//its provenance, with a warning when it is not commissioned or claimed by several orders
+//=========================================================================================
+func (t *SimpleChainCode) verifySerial(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 2")
+	}
+	item := strings.TrimSpace(args[0])
+	serialNumber := strings.TrimSpace(args[1])
+	if len(item) == 0 || len(serialNumber) == 0 {
+		return shim.Error("Error 2 Item and serial number cannot be null")
+	}
+	verification := &serialVerification{}
+	verification.Item = item
+	verification.SerialNumber = serialNumber
+	verification.ClaimingOrders = []string{}
+	verification.Provenance = []serialAssignment{}
+
+	//Orders of the item which claim the serial number
+	orderIterator, err := stub.GetStateByPartialCompositeKey("serialIndex", []string{serialNumber})
+	if err != nil {
+		return shim.Error("Error 3 " + err.Error())
+	}
+	defer orderIterator.Close()
+	activeClaims := 0
+	for orderIterator.HasNext() {
+		response, err := orderIterator.Next()
+		if err != nil {
+			return shim.Error("Error 4 " + err.Error())
+		}
+		_, returnKeys, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			return shim.Error("Error 5 " + err.Error())
+		}
+		orderBytes, err := stub.GetState(returnKeys[1])
+		if err != nil {
+			return shim.Error("Error 6 " + err.Error())
+		} else if orderBytes == nil {
+			continue
+		}
+		orderObj := order{}
+		err = json.Unmarshal(orderBytes, &orderObj)
+		if err != nil {
+			return shim.Error("Error 7 " + err.Error())
+		}
+		if orderObj.Item != item {
+			continue
+		}
+		verification.ClaimingOrders = append(verification.ClaimingOrders, orderObj.SalesOrderID)
+		if orderObj.ActualDeliveryDate.IsZero() {
+			activeClaims = activeClaims + 1
+		}
+	}
+
+	serialObj, err := getSerialRecord(stub, item, serialNumber)
+	if err != nil {
+		return shim.Error("Error 8 " + err.Error())
+	}
+	if serialObj == nil {
+		verification.Status = "Unknown"
+		verification.Warning = "Serial number " + serialNumber + " was never commissioned for item " + item + ", the device may be counterfeit"
+	} else {
+		verification.Genuine = true
+		verification.Status = serialObj.Status
+		verification.Manufacturer = serialObj.Manufacturer
+		verification.CommissionDate = serialObj.CommissionDate
+		verification.CurrentOrderID = serialObj.OrderID
+		verification.Provenance = serialObj.Assignments
+		if activeClaims > 1 {
+			verification.Genuine = false
+			verification.Status = "Duplicate"
+			verification.Warning = "Serial number " + serialNumber + " is claimed by " + strconv.Itoa(activeClaims) + " active orders, the device may be a duplicate"
+		}
+	}
+	verificationBytes, err := json.Marshal(verification)
+	if err != nil {
+		return shim.Error("Error 9 " + err.Error())
+	}
+	return shim.Success(verificationBytes)
+}
+
+func getSerialRecord(stub shim.ChaincodeStubInterface, item string, serialNumber string) (*serialRecord, error) {
+	serialKey, err := stub.CreateCompositeKey("serialRegistry", []string{item, serialNumber})
+	if err != nil {
+		return nil, err
+	}
+	serialBytes, err := stub.GetState(serialKey)
+	if err != nil {
+		return nil, err
+	}
+	if serialBytes == nil {
+		return nil, nil
+	}
+	serialObj := &serialRecord{}
+	err = json.Unmarshal(serialBytes, serialObj)
+	if err != nil {
+		return nil, err
+	}
+	return serialObj, nil
+}
+
+func putSerialRecord(stub shim.ChaincodeStubInterface, serialObj *serialRecord) error {
+	serialKey, err := stub.CreateCompositeKey("serialRegistry", []string{serialObj.Item, serialObj.SerialNumber})
+	if err != nil {
+		return err
+	}
+	serialBytes, err := json.Marshal(serialObj)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(serialKey, serialBytes)
+}
+
+//=========================================================================================
+//assignSerials - Common Function to assign the serial numbers of an order in the serial
+//registry. Serial numbers added to the order must be commissioned for the item by the
+//manufacturer of the order and free, serial numbers listed more than once are assigned
+//once, serial numbers removed from the order or of a delivered order are released
+//=========================================================================================
+func assignSerials(stub shim.ChaincodeStubInterface, orderObj *order, oldSerialNumber string) error {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	txDate := time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC()
+	oldSerials := splitTraceList(oldSerialNumber)
+	orderSerials := splitTraceList(orderObj.SerialNumber)
+	newSerials := []string{}
+	isNewSerial := map[string]bool{}
+	var i int
+	for i = 0; i < len(orderSerials); i++ {
+		if isNewSerial[orderSerials[i]] == true {
+			continue
+		}
+		isNewSerial[orderSerials[i]] = true
+		newSerials = append(newSerials, orderSerials[i])
+	}
+
+	//Release the serial numbers no longer on the order
+	for i = 0; i < len(oldSerials); i++ {
+		if isNewSerial[oldSerials[i]] == true {
+			delete(isNewSerial, oldSerials[i])
+			continue
+		}
+		serialObj, err := getSerialRecord(stub, orderObj.Item, oldSerials[i])
+		if err != nil {
+			return err
+		}
+		err = releaseSerial(stub, serialObj, orderObj.SalesOrderID, txDate, "Removed from order")
+		if err != nil {
+			return err
+		}
+	}
+	for i = 0; i < len(newSerials); i++ {
+		serialObj, err := getSerialRecord(stub, orderObj.Item, newSerials[i])
+		if err != nil {
+			return err
+		}
+		if serialObj == nil {
+			//Serial numbers of the order before the registry was introduced are not checked
+			if isNewSerial[newSerials[i]] == true {
+				return fmt.Errorf("Serial number %s is not commissioned for item %s", newSerials[i], orderObj.Item)
+			}
+			continue
+		}
+		//Serial numbers of the order already released on delivery stay released
+		if isNewSerial[newSerials[i]] == false && len(serialObj.OrderID) == 0 {
+			continue
+		}
+		if serialObj.OrderID != orderObj.SalesOrderID {
+			if len(serialObj.OrderID) != 0 {
+				return fmt.Errorf("Serial number %s already belongs to active order %s", newSerials[i], serialObj.OrderID)
+			}
+			if serialObj.Manufacturer != orderObj.Manufacturer {
+				return fmt.Errorf("Serial number %s is commissioned by manufacturer %s, not by the manufacturer %s of the order", newSerials[i], serialObj.Manufacturer, orderObj.Manufacturer)
+			}
+			serialObj.OrderID = orderObj.SalesOrderID
+			serialObj.Status = "Assigned"
+			serialObj.Assignments = append(serialObj.Assignments, serialAssignment{orderObj.SalesOrderID, orderObj.Customer, txDate, stub.GetTxID(), time.Time{}, ""})
+			err = putSerialRecord(stub, serialObj)
+			if err != nil {
+				return err
+			}
+		}
+		//The serial number is free for another order once the order is delivered, the record
+		//assigned above is released as is since GetState does not return this transaction's writes
+		if !orderObj.ActualDeliveryDate.IsZero() {
+			err = releaseSerial(stub, serialObj, orderObj.SalesOrderID, txDate, "Delivered")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Release a serial number record from the order, nothing to do if it belongs to another order
+func releaseSerial(stub shim.ChaincodeStubInterface, serialObj *serialRecord, orderID string, releaseDate time.Time, reason string) error {
+	if serialObj == nil || serialObj.OrderID != orderID {
+		return nil
+	}
+	serialObj.OrderID = ""
+	serialObj.Status = reason
+	if reason != "Delivered" {
+		serialObj.Status = "Commissioned"
+	}
+	var i int
+	for i = 0; i < len(serialObj.Assignments); i++ {
+		if serialObj.Assignments[i].OrderID == orderID && serialObj.Assignments[i].ReleasedDate.IsZero() {
+			serialObj.Assignments[i].ReleasedDate = releaseDate
+			serialObj.Assignments[i].Reason = reason
+		}
+	}
+	return putSerialRecord(stub, serialObj)
+}
+
+//=========================================================================================
+//queryOrderChanges - Function to return the fields changed by each transaction of an order
+//with their old and new values
+//Arguments: order ID, fields (optional, comma separated, e.g. owner,custody,currentLoc)
+//=========================================================================================
+func (t *SimpleChainCode) queryOrderChanges(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 1 or 2")
+	}
+	orderID := args[0]
+	fieldFilter := map[string]bool{}
+	if len(args) == 2 {
+		fields := splitTraceList(args[1])
+		var i int
+		for i = 0; i < len(fields); i++ {
+			fieldFilter[strings.ToLower(fields[i])] = true
+		}
+	}
+	orderIterator, err := stub.GetHistoryForKey(orderID)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	defer orderIterator.Close()
+
+	changes := []orderChange{}
+	previous := map[string]json.RawMessage{}
+	for orderIterator.HasNext() {
+		response, err := orderIterator.Next()
+		if err != nil {
+			return shim.Error("Error 3 " + err.Error())
+		}
+		current := map[string]json.RawMessage{}
+		if response.IsDelete == false && len(response.Value) != 0 {
+			err = json.Unmarshal(response.Value, &current)
+			if err != nil {
+				return shim.Error("Error 4 " + err.Error())
+			}
+		}
+		changeObj := orderChange{response.TxId, time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UTC(), "", response.IsDelete, getFieldChanges(previous, current, fieldFilter)}
+		if eventBytes, found := current["event"]; found {
+			err = json.Unmarshal(eventBytes, &changeObj.Event)
+			if err != nil {
+				return shim.Error("Error 5 " + err.Error())
+			}
+		}
+		previous = current
+		if len(changeObj.Changes) == 0 && response.IsDelete == false {
+			continue
+		}
+		changes = append(changes, changeObj)
+	}
+	changeBytes, err := json.Marshal(changes)
+	if err != nil {
+		return shim.Error("Error 6 " + err.Error())
+	}
+	return shim.Success(changeBytes)
+}
+
+//=========================================================================================
+//getFieldChanges - Common Function to compare two versions of a record field by field,
+//sorted by field name and limited to the fields of the filter when one is given
+//=========================================================================================
+func getFieldChanges(previous map[string]json.RawMessage, current map[string]json.RawMessage, fieldFilter map[string]bool) []fieldChange {
+	fields := []string{}
+	for field := range previous {
+		fields = append(fields, field)
+	}
+	for field := range current {
+		if _, found := previous[field]; !found {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	changes := []fieldChange{}
+	var i int
+	for i = 0; i < len(fields); i++ {
+		if len(fieldFilter) > 0 && fieldFilter[strings.ToLower(fields[i])] == false {
+			continue
+		}
+		oldValue, oldFound := previous[fields[i]]
+		newValue, newFound := current[fields[i]]
+		if oldFound && newFound && bytes.Equal(oldValue, newValue) {
+			continue
+		}
+		if !oldFound {
+			oldValue = json.RawMessage("null")
+		}
+		if !newFound {
+			newValue = json.RawMessage("null")
+		}
+		changes = append(changes, fieldChange{fields[i], oldValue, newValue})
+	}
+	return changes
+}
+
+//===================================================================================
+//queryOrders - Rich query on sales orders with pagination
+//Filters: customer, manufacturer, supplier, shipper, event, stage code, invalid
+//transaction flag (Y/N), expected delivery from date, to date (empty = any)
+//===================================================================================
+func (t *SimpleChainCode) queryOrders(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 11 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 11")
+	}
+	pageSize, err := strconv.Atoi(args[9])
+	if err != nil || pageSize <= 0 {
+		return shim.Error("Error 2 Page size must be a positive number")
+	}
+	bookmark := args[10]
+
+	//Each filter given is an exact match on its order field, the arguments are only used
+	//as selector values
+	selector := map[string]interface{}{"objectType": "sales order"}
+	filterFields := []string{"customer", "manufacturer", "supplier", "shipper", "event", "attribute2"}
+	var i int
+	for i = 0; i < len(filterFields); i++ {
+		if len(args[i]) != 0 {
+			selector[filterFields[i]] = args[i]
+		}
+	}
+	invalidTrx := args[6]
+	if len(invalidTrx) != 0 {
+		if invalidTrx != "Y" && invalidTrx != "N" {
+			return shim.Error("Error 3 Invalid transaction flag must be Y or N")
+		}
+		selector["invalidTrx"] = invalidTrx
+	}
+	if len(args[7]) != 0 || len(args[8]) != 0 {
+		deliveryRange, err := getDeliveryDateRange(args[7], args[8])
+		if err != nil {
+			return shim.Error("Error 4 " + err.Error())
+		}
+		selector["expectedDeliveryDate"] = deliveryRange
+	}
+	return getOrderPage(stub, selector, pageSize, bookmark)
+}
+
+//===================================================================================
+//queryOpenOrdersByParty - Rich query on the sales orders of a party which are not
+//delivered yet, with pagination
+//Arguments: party type (customer, manufacturer, supplier, shipper), party, page size,
+//bookmark
+//===================================================================================
+func (t *SimpleChainCode) queryOpenOrdersByParty(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return shim.Error("Error 1 Incorrect number of arguments, expecting 4")
+	}
+	partyType := strings.ToLower(strings.TrimSpace(args[0]))
+	if partyType != "customer" && partyType != "manufacturer" && partyType != "supplier" && partyType != "shipper" {
+		return shim.Error("Error 2 Party type must be customer, manufacturer, supplier or shipper")
+	}
+	if len(args[1]) == 0 {
+		return shim.Error("Error 3 Party cannot be null")
+	}
+	pageSize, err := strconv.Atoi(args[2])
+	if err != nil || pageSize <= 0 {
+		return shim.Error("Error 4 Page size must be a positive number")
+	}
+	//Undelivered orders still carry the zero actual delivery date set by createOrder
+	selector := map[string]interface{}{
+		"objectType":         "sales order",
+		partyType:            args[1],
+		"actualDeliveryDate": time.Time{}.Format(time.RFC3339Nano),
+	}
+	return getOrderPage(stub, selector, pageSize, args[3])
+}
+
+//===================================================================================
+//getOrderPage - Common Function to run a rich query on sales orders and return one
+//page of orders with the number fetched and the bookmark of the next page
+//===================================================================================
+func getOrderPage(stub shim.ChaincodeStubInterface, selector map[string]interface{}, pageSize int, bookmark string) pb.Response {
+	queryBytes, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return shim.Error("Error 1 " + err.Error())
+	}
+	orderIterator, metadata, err := stub.GetQueryResultWithPagination(string(queryBytes), int32(pageSize), bookmark)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	defer orderIterator.Close()
+
+	var buffer bytes.Buffer
+	isRecordWritten := false
+	buffer.WriteString("{\"records\":[")
+	for orderIterator.HasNext() {
+		response, err := orderIterator.Next()
+		if err != nil {
+			return shim.Error("Error 3 " + err.Error())
+		}
+		if isRecordWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Value)
+		isRecordWritten = true
+	}
+	buffer.WriteString("],\"fetchedRecordsCount\":")
+	buffer.WriteString(strconv.Itoa(int(metadata.FetchedRecordsCount)))
+	buffer.WriteString(",\"bookmark\":\"")
+	buffer.WriteString(metadata.Bookmark)
+	buffer.WriteString("\"}")
+	return shim.Success(buffer.Bytes())
+}
+
+//===================================================================================
+//getDeliveryDateRange - Common Function to build the selector range of a delivery
+//date. Dates are stored in RFC3339Nano, which strips the trailing zeros of the fraction
+//of a second, so ...:00Z sorts after ...:00.5Z. The bounds are written with a fixed-width
+//fraction instead, a bound on a whole second (...:00.000000000Z) sorts before every date
+//stored in that second and after every date of the seconds before. A bound with a
+//fraction of a second is only exact for the dates of that second stored with as many
+//digits. The to date is inclusive, given as YYYY-MM-DD it includes all of that day
+//===================================================================================
+func getDeliveryDateRange(fromDate string, toDate string) (map[string]interface{}, error) {
+	layout := "2006-01-02T15:04:05.000000000Z07:00"
+	deliveryRange := map[string]interface{}{}
+	if len(fromDate) != 0 {
+		from, err := parseDeliveryDate(fromDate)
+		if err != nil {
+			return nil, err
+		}
+		deliveryRange["$gte"] = from.Format(layout)
+	}
+	if len(toDate) != 0 {
+		to, err := parseDeliveryDate(toDate)
+		if err != nil {
+			return nil, err
+		}
+		if len(toDate) == len("2006-01-02") {
+			deliveryRange["$lt"] = to.AddDate(0, 0, 1).Format(layout)
+		} else {
+			deliveryRange["$lte"] = to.Format(layout)
+		}
+	}
+	return deliveryRange, nil
+}
+
+//Delivery dates are given in the layout of createOrder or as YYYY-MM-DD
+func parseDeliveryDate(date string) (time.Time, error) {
+	deliveryDate, err := time.Parse("2006-01-02T15:04:05.000Z", date)
+	if err != nil {
+		deliveryDate, err = time.Parse("2006-01-02", date)
+		if err != nil {
+			return deliveryDate, fmt.Errorf("Invalid delivery date %s, expecting YYYY-MM-DD or YYYY-MM-DDThh:mm:ss.sssZ", date)
+		}
+	}
+	return deliveryDate.UTC(), nil
+}
@@ -14,10 +14,11 @@ import (
 //================================================
 type SimpleChaincode struct{}
 type UserProfile struct {
-	ObjectType      string `json:"objectType"`
-	ProfileID       string `json:"profileID"`
-	UserPreferences string `json:"userPreferences"`
-	Event           string `json:"event"`
+	ObjectType        string `json:"objectType"`
+	ProfileID         string `json:"profileID"`
+	UserPreferences   string `json:"userPreferences"`
+	Event             string `json:"event"`
+	PreferredLanguage string `json:"preferredLanguage"`
 }
 
 //=============
@@ -68,6 +69,10 @@ func (t *SimpleChaincode) createProfile(stub shim.ChaincodeStubInterface, args [
 	profileID := args[0]
 	userPreferences := args[1]
 	event := "User profile created and preferences added"
+	preferredLanguage := ""
+	if len(args) > 2 {
+		preferredLanguage = args[2]
+	}
 
 	//Check if the profile ID already exists
 	userBytes, err := stub.GetState(profileID)
@@ -77,7 +82,7 @@ func (t *SimpleChaincode) createProfile(stub shim.ChaincodeStubInterface, args [
 		return shim.Error("Profile with ID " + profileID + " already exists in the system")
 	}
 	//Create the JSON object interface
-	profileObj := &UserProfile{objectType, profileID, userPreferences, event}
+	profileObj := &UserProfile{objectType, profileID, userPreferences, event, preferredLanguage}
 
 	//Convert the JSON object to bytes
 	profileBytes, err := json.Marshal(profileObj)
@@ -142,25 +147,35 @@ func (t *SimpleChaincode) updateProfile(stub shim.ChaincodeStubInterface, args [
 	} else if userBytes == nil {
 		return shim.Error("Profile with ID " + profileID + " does not exist in the system")
 	}
+	//Keep the preferred language of the profile unless a new one is provided
+	existingObj := &UserProfile{}
+	err = json.Unmarshal(userBytes, existingObj)
+	if err != nil {
+		return shim.Error("Error 2 " + err.Error())
+	}
+	preferredLanguage := existingObj.PreferredLanguage
+	if len(args) > 2 {
+		preferredLanguage = args[2]
+	}
 	//Create the JSON object interface
-	profileObj := &UserProfile{objectType, profileID, userPreferences, event}
+	profileObj := &UserProfile{objectType, profileID, userPreferences, event, preferredLanguage}
 
 	//Convert the JSON object to bytes
 	profileBytes, err := json.Marshal(profileObj)
 	if err != nil {
-		return shim.Error("Error 2 " + err.Error())
+		return shim.Error("Error 3 " + err.Error())
 	}
 
 	//Create a write set with profile ID as key
 	err = stub.PutState(profileID, profileBytes)
 	if err != nil {
-		return shim.Error("Error 3 " + err.Error())
+		return shim.Error("Error 4 " + err.Error())
 	}
 
 	//Publish the event of profile update
 	err = stub.SetEvent(event, profileBytes)
 	if err != nil {
-		return shim.Error("Error 4 " + err.Error())
+		return shim.Error("Error 5 " + err.Error())
 	}
 
 	return shim.Success(profileBytes)